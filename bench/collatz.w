@@ -0,0 +1,12 @@
+# totals the collatz stopping times of the numbers below 30000
+: collatz ( n:f -- steps:f )
+	0 swap dup 1 != {
+		dup 2 mod { 3 * 1 + 2 * 0 } 2 /
+		swap ++ swap
+		dup 1 !=
+	} drop
+;
+0 30000 dup {
+	dup collatz swap rot + swap
+	-- dup
+} drop println
@@ -0,0 +1,7 @@
+# naive recursive fibonacci
+: fib
+	dup 2 >= {
+		dup 1 - fib swap 2 - fib + 0
+	}
+;
+25 fib println
@@ -0,0 +1,5 @@
+# sums the numbers from one to a million
+0 1000000 dup {
+	dup rot + swap
+	-- dup
+} drop println
@@ -23,26 +23,21 @@ with open("src/builtins_generated.go", "w") as f:
 
 		inpstr = ", ".join(chr(ord('a')+i) for i in range(num_inputs))
 		
-		f.write(f'\t{{category: "{category}", name: "{name}", inputs: "{inputs}", outputs: "{outputs}", proc: func(state *EvalState) bool {{\n')
+		f.write(f'\t{{category: "{category}", name: "{name}", inputs: "{inputs}", outputs: "{outputs}", proc: func(state *EvalState) error {{\n')
 
-		if num_inputs == 0 and num_outputs == 0:
-			if proc:
-				f.write(f'\t\t{proc}\n')
-			f.write(f'\t\treturn true\n')
-		elif num_inputs == 0:
-			f.write(f'\t\treturn state.push{outputs}({proc})\n')
-		elif num_outputs == 0:
-			f.write(f'\t\tif {inpstr}, ok := state.pop{inputs}(); ok {{\n')
-			if proc:
-				f.write(f'\t\t\t{proc}\n')
-			f.write(f'\t\t\treturn true\n')
+		# the pop helpers check the stack against the inputs spec, returning
+		# errors that call turns into messages naming the builtin
+		if num_inputs > 0:
+			f.write(f'\t\t{inpstr}, err := state.pop{inputs}()\n')
+			f.write(f'\t\tif err != nil {{\n')
+			f.write(f'\t\t\treturn err\n')
 			f.write(f'\t\t}}\n')
-			f.write(f'\t\treturn false\n')
+		if num_outputs > 0:
+			f.write(f'\t\treturn state.push{outputs}({proc})\n')
 		else:
-			f.write(f'\t\tif {inpstr}, ok := state.pop{inputs}(); ok {{\n')
-			f.write(f'\t\t\treturn state.push{outputs}({proc})\n')
-			f.write(f'\t\t}}\n')
-			f.write(f'\t\treturn false\n')
+			if proc:
+				f.write(f'\t\t{proc}\n')
+			f.write(f'\t\treturn nil\n')
 		f.write(f'\t}}}},\n')
 
 	f.write("}\n")
\ No newline at end of file
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkScripts runs every script in bench/ with each engine.
+func BenchmarkScripts(b *testing.B) {
+	scripts, err := filepath.Glob("../bench/*.w")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, script := range scripts {
+		source, err := os.ReadFile(script)
+		if err != nil {
+			b.Fatal(err)
+		}
+		parseState := parse(lex(script, bytes.NewReader(source), 0))
+		if parseState.err != nil {
+			b.Fatal(parseState.err)
+		}
+		for _, engine := range engines {
+			b.Run(fmt.Sprintf("%v/%v", filepath.Base(script), engine), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					words, err := loadStdLib(false)
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+					captureStdout(b, func() {
+						err = eval(parseState, words, Options{engine: engine}).err
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
 
-type Proc func(state *EvalState) bool
+// Proc runs a builtin, returning why it failed if it did. Procs that report
+// their own errors return state.err.
+type Proc func(state *EvalState) error
 
 type Builtin struct {
 	category string
@@ -10,58 +17,141 @@ type Builtin struct {
 	inputs   string
 	outputs  string
 	proc     Proc
+	dynamic  bool // runs or defines code that can't be seen ahead of time
 }
 
-var Builtins = []Builtin{
-	{category: "io", name: "runstring", inputs: "1s", outputs: "0", proc: func(state *EvalState) bool {
-		script, ok := state.pop1s()
-		if !ok {
-			return false
+// dynamicBuiltins names the builtins that run or define code which can't be
+// seen ahead of time. It's filled in by init, as some builtins depend on it.
+var dynamicBuiltins = make(map[string]bool)
+
+func init() {
+	for _, builtin := range Builtins {
+		if builtin.dynamic {
+			dynamicBuiltins[builtin.name] = true
 		}
-		token := state.currentToken()
-		if token == nil {
-			return false
+	}
+}
+
+// dynamicWord returns the first call under token to a dynamic builtin, if
+// there is one.
+func dynamicWord(token *Token) (string, bool) {
+	for i := range token.children {
+		child := &token.children[i]
+		if child.kind == TokenWord && dynamicBuiltins[child.value.text] {
+			return child.value.text, true
 		}
-		lexState := lex(token.file, script)
-		if lexState.err != nil {
-			return false
+		if name, ok := dynamicWord(child); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ExitError stops a script that calls `exit`. It isn't reported as an
+// error, just handed back to main to exit with.
+type ExitError struct {
+	status int
+}
+
+func (err *ExitError) Error() string {
+	return fmt.Sprintf("exit status %v", err.status)
+}
+
+// runstrings counts the scripts run by `runstring`, so each gets a file name
+// of its own to show its errors against.
+var runstrings int
+
+// Builtins written by hand. Those that can fail after checking their input
+// peek at it, only dropping it once they've succeeded.
+var Builtins = []Builtin{
+	{category: "io", name: "runstring", dynamic: true, inputs: "1s", outputs: "0", proc: func(state *EvalState) error {
+		script, err := state.peek1s()
+		if err != nil {
+			return err
 		}
-		parseState := parse(lexState)
+		runstrings++
+		file := fmt.Sprintf("<runstring %v>", runstrings)
+		// kept so errors in it can be shown with its source
+		scriptSources[file] = script
+		parseState := parse(lex(file, strings.NewReader(script), state.options.maxErrors))
 		if parseState.err != nil {
-			return false
+			// reported as they are, pointing into the script
+			state.err = parseState.err
+			return state.err
+		} else if !state.load(parseState.root) {
+			return state.err
 		}
-		state.scopes.Push(&Scope{parseState.root, 0})
-		return true
+		state.values.Drop(1)
+		state.pushScope(parseState.root)
+		return nil
 	}},
-	{category: "io", name: "loadfile", inputs: "1s", outputs: "1s", proc: func(state *EvalState) bool {
-		filename, ok := state.pop1s()
-		if !ok {
-			return false
+	{category: "io", name: "loadfile", inputs: "1s", outputs: "1s", proc: func(state *EvalState) error {
+		filename, err := state.peek1s()
+		if err != nil {
+			return err
 		}
 		file, err := os.ReadFile(filename)
 		if err != nil {
-			return false
+			return fmt.Errorf("failed to read file: %w", err)
 		}
+		state.values.Drop(1)
 		return state.push1s(string(file))
 	}},
-	{category: "io", name: "runfile", inputs: "1s", outputs: "0", proc: func(state *EvalState) bool {
-		filename, ok := state.pop1s()
-		if !ok {
-			return false
+	{category: "io", name: "runfile", dynamic: true, inputs: "1s", outputs: "0", proc: func(state *EvalState) error {
+		filename, err := state.peek1s()
+		if err != nil {
+			return err
 		}
-		file, err := os.ReadFile(filename)
+		parseState, err := loadScript(filename, state.options)
 		if err != nil {
-			return false
+			return fmt.Errorf("failed to read file: %w", err)
+		} else if parseState.err != nil {
+			state.err = parseState.err
+			return state.err
+		} else if !state.load(parseState.root) {
+			return state.err
 		}
-		lexState := lex(filename, string(file))
-		if lexState.err != nil {
-			return false
+		state.values.Drop(1)
+		state.pushScope(parseState.root)
+		return nil
+	}},
+	{category: "control", name: "exit", inputs: "1f", outputs: "0", proc: func(state *EvalState) error {
+		values, err := state.topKind(1, ValueNumber)
+		if err != nil {
+			return err
 		}
-		parseState := parse(lexState)
-		if parseState.err != nil {
-			return false
+		status := values[0].number
+		if status != math.Trunc(status) || status < 0 || status > 255 {
+			return fmt.Errorf("exit status should be a whole number from 0 to 255, got %v", status)
+		}
+		state.values.Drop(1)
+		state.err = &ExitError{int(status)}
+		return state.err
+	}},
+	{category: "dictionary", name: "forget", dynamic: true, inputs: "1s", outputs: "0", proc: func(state *EvalState) error {
+		name, err := state.peek1s()
+		if err != nil {
+			return err
+		}
+		if !state.forget(name) {
+			return state.err
+		}
+		state.values.Drop(1)
+		return nil
+	}},
+	{category: "dictionary", name: "marker", dynamic: true, inputs: "1s", outputs: "0", proc: func(state *EvalState) error {
+		name, err := state.peek1s()
+		if err != nil {
+			return err
+		}
+		mark := len(state.history)
+		if !state.define(name, Word{builtin: func(state *EvalState) error {
+			state.rollback(mark)
+			return nil
+		}}) {
+			return state.err
 		}
-		state.scopes.Push(&Scope{parseState.root, 0})
-		return true
+		state.values.Drop(1)
+		return nil
 	}},
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// buildMagic starts every file written by `wafer build`, so they can be told
+// apart from scripts.
+const buildMagic = "WAFERBC\x00"
+
+// cacheFormat changes whenever the layout of cachedToken does. It's written
+// after buildMagic too, so built scripts from other versions can be told
+// apart.
+const cacheFormat = 2
+
+// The cache is pruned whenever something is added to it. Entries unused for
+// maxCacheAge are removed, then the least recently used ones until the rest
+// fit in maxCacheSize.
+const (
+	maxCacheAge  = 30 * 24 * time.Hour
+	maxCacheSize = 64 << 20
+)
+
+// cachedToken is a Token in a form gob can encode. Every token in a script
+// has the same file, so it's only stored once.
+type cachedToken struct {
+	Kind      TokenKind
+	Value     cachedValue
+	Line      int
+	Col       int
+	EndLine   int
+	EndCol    int
+	Children  []cachedToken
+	Signature *cachedSignature
+}
+
+type cachedValue struct {
+	Kind   ValueKind
+	Number float64
+	Text   string
+}
+
+type cachedSignature struct {
+	Inputs  []cachedParam
+	Outputs []cachedParam
+}
+
+type cachedParam struct {
+	Name string
+	Type StackType
+}
+
+type cachedScript struct {
+	Format int
+	File   string
+	Root   cachedToken
+}
+
+func cacheParams(params []Param) []cachedParam {
+	cached := make([]cachedParam, len(params))
+	for i, param := range params {
+		cached[i] = cachedParam{param.name, param.typ}
+	}
+	return cached
+}
+
+func uncacheParams(cached []cachedParam) []Param {
+	params := make([]Param, len(cached))
+	for i, param := range cached {
+		params[i] = Param{param.Name, param.Type}
+	}
+	return params
+}
+
+func cacheToken(token *Token) cachedToken {
+	cached := cachedToken{
+		Kind:    token.kind,
+		Value:   cachedValue{token.value.kind, token.value.number, token.value.text},
+		Line:    token.line,
+		Col:     token.col,
+		EndLine: token.endLine,
+		EndCol:  token.endCol,
+	}
+	if token.signature != nil {
+		cached.Signature = &cachedSignature{cacheParams(token.signature.inputs), cacheParams(token.signature.outputs)}
+	}
+	for i := range token.children {
+		cached.Children = append(cached.Children, cacheToken(&token.children[i]))
+	}
+	return cached
+}
+
+// uncacheToken fills in token from its cached form, building its children
+// in place so their parent pointers stay valid.
+func uncacheToken(token *Token, cached *cachedToken, file string, parent *Token) {
+	*token = Token{
+		kind:    cached.Kind,
+		parent:  parent,
+		value:   Value{cached.Value.Kind, cached.Value.Number, cached.Value.Text},
+		file:    file,
+		line:    cached.Line,
+		col:     cached.Col,
+		endLine: cached.EndLine,
+		endCol:  cached.EndCol,
+	}
+	if cached.Signature != nil {
+		token.signature = &Signature{uncacheParams(cached.Signature.Inputs), uncacheParams(cached.Signature.Outputs)}
+	}
+	if len(cached.Children) > 0 {
+		token.children = make([]Token, len(cached.Children))
+		for i := range cached.Children {
+			uncacheToken(&token.children[i], &cached.Children[i], file, token)
+		}
+	}
+}
+
+func encodeScript(writer io.Writer, root *Token, file string) error {
+	return gob.NewEncoder(writer).Encode(cachedScript{cacheFormat, file, cacheToken(root)})
+}
+
+func decodeScript(reader io.Reader) (ParseState, error) {
+	var script cachedScript
+	if err := gob.NewDecoder(reader).Decode(&script); err != nil {
+		return ParseState{}, err
+	} else if script.Format != cacheFormat {
+		return ParseState{}, errors.New("compiled with a different version of wafer")
+	}
+	root := &Token{}
+	uncacheToken(root, &script.Root, script.File, nil)
+	return ParseState{file: script.File, root: root}, nil
+}
+
+// cacheKey identifies a script by its name and contents, and by the wafer
+// executable that parsed it, so rebuilding wafer invalidates the cache.
+func cacheKey(file string, reader io.Reader) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\x00%v\x00", cacheFormat, file)
+	if exe, err := os.Executable(); err == nil {
+		if info, err := os.Stat(exe); err == nil {
+			fmt.Fprintf(hash, "%v\x00%v\x00", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func cachePath(key string) (string, bool) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(dir, APP_NAME, key+".gob"), true
+}
+
+// writeCache saves a parsed script, ignoring any errors since the cache is
+// only there to save time.
+func writeCache(path string, parseState ParseState) {
+	if os.MkdirAll(filepath.Dir(path), 0o755) != nil {
+		return
+	}
+	defer pruneCache(filepath.Dir(path))
+	temp, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(temp.Name())
+	err = encodeScript(temp, parseState.root, parseState.file)
+	if closeErr := temp.Close(); err == nil && closeErr == nil {
+		os.Rename(temp.Name(), path)
+	}
+}
+
+// pruneCache removes old entries from the cache in dir, and then the least
+// recently used ones while it's too big.
+func pruneCache(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type cacheEntry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	kept := []cacheEntry{}
+	size := int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if time.Since(info.ModTime()) > maxCacheAge {
+			os.Remove(path)
+			continue
+		}
+		kept = append(kept, cacheEntry{path, info.Size(), info.ModTime()})
+		size += info.Size()
+	}
+	slices.SortFunc(kept, func(a, b cacheEntry) int { return a.used.Compare(b.used) })
+	for _, entry := range kept {
+		if size <= maxCacheSize {
+			break
+		}
+		os.Remove(entry.path)
+		size -= entry.size
+	}
+}
+
+// parseCached parses a script, or loads it from the cache if it has been
+// parsed before. The reader is read twice, once to work out its key.
+func parseCached(file string, reader io.ReadSeeker, maxErrors int) ParseState {
+	key, err := cacheKey(file, reader)
+	path, ok := cachePath(key)
+	if _, seekErr := reader.Seek(0, io.SeekStart); seekErr != nil {
+		ok = false
+	}
+	if err != nil || !ok {
+		return parse(lex(file, reader, maxErrors))
+	}
+	if cached, err := os.Open(path); err == nil {
+		parseState, err := decodeScript(bufio.NewReader(cached))
+		cached.Close()
+		if err == nil {
+			// pruning goes by when entries were last used
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return parseState
+		}
+	}
+	parseState := parse(lex(file, reader, maxErrors))
+	if parseState.err == nil {
+		writeCache(path, parseState)
+	}
+	return parseState
+}
+
+// stdinFile is the file name given to a script read from standard input.
+const stdinFile = "<stdin>"
+
+// loadScript reads and parses a script file, which may also be one built by
+// `wafer build`, or read from standard input if the file name is `-`. Errors
+// reading the file are returned, while syntax errors are left in the parse
+// state.
+func loadScript(filename string, options Options) (ParseState, error) {
+	if filename == "-" {
+		// lexed as it arrives, so a long piped script is never held in
+		// memory, or cached
+		return readScript(stdinFile, os.Stdin, options)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return ParseState{}, err
+	}
+	defer file.Close()
+	return readScript(filename, file, options)
+}
+
+func readScript(filename string, source io.ReadSeeker, options Options) (ParseState, error) {
+	reader := bufio.NewReader(source)
+	if magic, err := reader.Peek(len(buildMagic)); err == nil && string(magic) == buildMagic {
+		reader.Discard(len(buildMagic))
+		var format uint32
+		if err := binary.Read(reader, binary.LittleEndian, &format); err != nil {
+			return ParseState{}, fmt.Errorf("%v: %w", filename, err)
+		} else if format != cacheFormat {
+			return ParseState{}, fmt.Errorf("%v was built by a version of wafer using format %v, but this one uses format %v; build it again from its source", filename, format, cacheFormat)
+		}
+		parseState, err := decodeScript(reader)
+		if err != nil {
+			return ParseState{}, fmt.Errorf("%v: %w", filename, err)
+		}
+		return parseState, nil
+	}
+	if !options.cache {
+		return parse(lex(filename, reader, options.maxErrors)), nil
+	} else if _, err := source.Seek(0, io.SeekStart); err != nil {
+		// pipes and the like can't be read twice to work out their key, so
+		// aren't cached
+		return parse(lex(filename, reader, options.maxErrors)), nil
+	}
+	return parseCached(filename, source, options.maxErrors), nil
+}
+
+// buildScript writes out a parsed script in a form wafer can run without
+// parsing it again.
+func buildScript(parseState ParseState, output string) error {
+	var built bytes.Buffer
+	built.WriteString(buildMagic)
+	binary.Write(&built, binary.LittleEndian, uint32(cacheFormat))
+	if err := encodeScript(&built, parseState.root, parseState.file); err != nil {
+		return err
+	}
+	return os.WriteFile(output, built.Bytes(), 0o644)
+}
+
+// buildOutput is where `wafer build` writes a script when not told otherwise.
+func buildOutput(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".wbc"
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadStdin checks a script piped to standard input is lexed as it
+// arrives, rather than read in whole and kept.
+func TestLoadStdin(t *testing.T) {
+	read, write, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdin
+	os.Stdin = read
+	defer func() { os.Stdin = saved }()
+	go func() {
+		write.WriteString(": twice 2 * ;\n3 twice println\n")
+		write.Close()
+	}()
+
+	parseState, err := loadScript("-", Options{cache: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if parseState.err != nil {
+		t.Fatal(parseState.err)
+	}
+	if got := formatTokens(parseState.root.children); got != ": twice 2 * ; 3 twice println" {
+		t.Errorf("read %q from standard input", got)
+	}
+	if _, ok := scriptSources[stdinFile]; ok {
+		t.Errorf("standard input was kept in memory")
+	}
+}
+
+// useCacheDir points the user cache directory somewhere empty for a test,
+// returning where scripts will be cached.
+func useCacheDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	return filepath.Join(dir, APP_NAME)
+}
+
+func cacheEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := filepath.Glob(filepath.Join(dir, "*.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestParseCached(t *testing.T) {
+	dir := useCacheDir(t)
+	source := ": sq ( a:f -- b:f ) dup * ;\n3 sq f\"{}!\" println\n"
+	parsed := parse(lex("a.w", strings.NewReader(source), 0))
+
+	first := parseCached("a.w", strings.NewReader(source), 0)
+	if first.err != nil {
+		t.Fatal(first.err)
+	}
+	entries := cacheEntries(t, dir)
+	if len(entries) != 1 {
+		t.Fatalf("cached %v, want one entry", entries)
+	}
+	cached := parseCached("a.w", strings.NewReader(source), 0)
+	if cached.err != nil {
+		t.Fatal(cached.err)
+	}
+	assertSameTokens(t, cached.root, parsed.root)
+
+	// the entry really is what's read back
+	other := parseSource("1 println", 0)
+	file, err := os.Create(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeScript(file, other.root, "a.w")
+	file.Close()
+	if got := formatTokens(parseCached("a.w", strings.NewReader(source), 0).root.children); got != "1 println" {
+		t.Errorf("read %q back from the cache, want what was written to it", got)
+	}
+
+	// changing the script or its name gives it a new entry
+	parseCached("a.w", strings.NewReader(source+"4 sq\n"), 0)
+	parseCached("b.w", strings.NewReader(source), 0)
+	if entries := cacheEntries(t, dir); len(entries) != 3 {
+		t.Errorf("cached %v, want an entry for each version of the script", entries)
+	}
+
+	// a broken entry is parsed again and replaced
+	for _, entry := range cacheEntries(t, dir) {
+		os.WriteFile(entry, []byte("garbage"), 0o644)
+	}
+	assertSameTokens(t, parseCached("a.w", strings.NewReader(source), 0).root, parsed.root)
+	assertSameTokens(t, parseCached("a.w", strings.NewReader(source), 0).root, parsed.root)
+
+	// scripts with syntax errors aren't cached
+	if parseCached("c.w", strings.NewReader("}"), 0).err == nil {
+		t.Error("a syntax error was lost")
+	} else if entries := cacheEntries(t, dir); len(entries) != 3 {
+		t.Errorf("cached %v after a syntax error", entries)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	key := func(file, source string) string {
+		key, err := cacheKey(file, strings.NewReader(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	if key("a.w", "1") != key("a.w", "1") {
+		t.Error("the same script has different keys")
+	}
+	if key("a.w", "1") == key("a.w", "2") {
+		t.Error("changing the script keeps its key")
+	}
+	if key("a.w", "1") == key("b.w", "1") {
+		t.Error("renaming the script keeps its key")
+	}
+}
+
+// assertSameTokens checks two trees match, positions and all.
+func assertSameTokens(t *testing.T, got, want *Token) {
+	t.Helper()
+	// roots only get a file name once they've been stored
+	sameFile := got.file == want.file || got.kind == TokenRoot
+	if got.kind != want.kind || got.value != want.value || !sameFile ||
+		got.line != want.line || got.col != want.col || got.endLine != want.endLine || got.endCol != want.endCol ||
+		fmt.Sprint(got.signature) != fmt.Sprint(want.signature) || len(got.children) != len(want.children) {
+		t.Fatalf("got %v token %q at %v:%v:%v-%v:%v, want %v token %q at %v:%v:%v-%v:%v",
+			got.kind, got.value.text, got.file, got.line, got.col, got.endLine, got.endCol,
+			want.kind, want.value.text, want.file, want.line, want.col, want.endLine, want.endCol)
+	}
+	for i := range got.children {
+		assertSameTokens(t, &got.children[i], &want.children[i])
+	}
+}
+
+func TestBuildScript(t *testing.T) {
+	useCacheDir(t)
+	dir := t.TempDir()
+	source := ": sq ( a:f -- b:f ) dup * ;\n3 sq println\n\"x\" sq\n"
+	built := filepath.Join(dir, "a.wbc")
+	if err := buildScript(parseSource(source, 0), built); err != nil {
+		t.Fatal(err)
+	}
+	parseState, err := loadScript(built, Options{cache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameTokens(t, parseState.root, parseSource(source, 0).root)
+
+	// it runs, failing in the same place as the source
+	words, err := loadStdLib(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state EvalState
+	output := captureStdout(t, func() { state = eval(parseState, words, Options{}) })
+	_, want := runSource(t, source, Options{})
+	if output != "9\n" || state.err == nil || want == nil || state.err.Error() != want.Error() {
+		t.Errorf("printed %q and failed with %v, want \"9\\n\" and %v", output, state.err, want)
+	}
+
+	// built files are never cached
+	if entries := cacheEntries(t, filepath.Join(os.Getenv("XDG_CACHE_HOME"), APP_NAME)); len(entries) != 0 {
+		t.Errorf("cached %v", entries)
+	}
+}
+
+func TestReadBuiltScriptErrors(t *testing.T) {
+	var valid bytes.Buffer
+	valid.WriteString(buildMagic)
+	binary.Write(&valid, binary.LittleEndian, uint32(cacheFormat))
+	encodeScript(&valid, parseSource("1 println", 0).root, "a.w")
+
+	oldFormat := bytes.Clone(valid.Bytes())
+	binary.LittleEndian.PutUint32(oldFormat[len(buildMagic):], cacheFormat-1)
+	tests := []struct {
+		name  string
+		data  []byte
+		fails string
+	}{
+		{"old format", oldFormat, fmt.Sprintf("uses format %v; build it again", cacheFormat)},
+		{"truncated", valid.Bytes()[:valid.Len()-4], "a.wbc: "},
+		{"no format", []byte(buildMagic + "\x01"), "a.wbc: "},
+		{"garbage", append([]byte(buildMagic+"\x02\x00\x00\x00"), "garbage"...), "a.wbc: "},
+	}
+	for _, test := range tests {
+		_, err := readScript("a.wbc", bytes.NewReader(test.data), Options{})
+		if err == nil || !strings.Contains(err.Error(), test.fails) {
+			t.Errorf("%v: failed with %v, want an error containing %q", test.name, err, test.fails)
+		}
+	}
+
+	// without the magic it's just a script
+	parseState, err := readScript("a.w", strings.NewReader("WAFERBC 1"), Options{})
+	if err != nil || parseState.err != nil || len(parseState.root.children) != 2 {
+		t.Errorf("a script starting like a built one was read as %v (%v, %v)", parseState.root, err, parseState.err)
+	}
+	if _, err := readScript("a.wbc", bytes.NewReader(valid.Bytes()), Options{}); err != nil {
+		t.Errorf("a valid built script failed with %v", err)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(-age)
+		os.Chtimes(path, used, used)
+		return path
+	}
+	stale := write("stale.gob", 10, maxCacheAge+time.Hour)
+	oldest := write("oldest.gob", maxCacheSize/2, 3*time.Hour)
+	older := write("older.gob", maxCacheSize/2, 2*time.Hour)
+	newest := write("newest.gob", 10, time.Hour)
+	pruneCache(dir)
+	for path, kept := range map[string]bool{stale: false, oldest: false, older: true, newest: true} {
+		if _, err := os.Stat(path); (err == nil) != kept {
+			t.Errorf("%v kept: %v, want %v", filepath.Base(path), err == nil, kept)
+		}
+	}
+}
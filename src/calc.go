@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// maxUndo is how many changes to the stack calculator mode can undo.
+const maxUndo = 100
+
+// calcBases are the bases results can be shown in, which are those numbers
+// can be written in too.
+var calcBases = map[int]string{2: "0b", 8: "0o", 10: "", 16: "0x"}
+
+// Calculator is the REPL set up as an RPN calculator. It shows the stack
+// vertically, names each new result `$1`, `$2` and so on, and can undo
+// changes to the stack.
+type Calculator struct {
+	repl      *Repl
+	results   []Value
+	undo      []calcSnapshot
+	precision int // digits shown after the decimal point, or -1 for as many as needed
+	base      int
+	// the value the last `$n` pushed and the stack depth it left, so a
+	// result that's only been recalled isn't named again
+	recalled      Value
+	recalledDepth int
+}
+
+// calcSnapshot is what undo goes back to.
+type calcSnapshot struct {
+	values  []Value
+	results int
+}
+
+func newCalculator(words *Dictionary, options Options) *Calculator {
+	calc := &Calculator{repl: newRepl(words, options), precision: -1, base: 10}
+	repl := calc.repl
+	quit := repl.commands[len(repl.commands)-1]
+	repl.commands = append(repl.commands[:len(repl.commands)-1],
+		ReplCommand{".undo", "", "undo the last change to the stack", calc.undoChange},
+		ReplCommand{".precision", "[digits|auto]", "show or set how many digits follow the decimal point", calc.setPrecision},
+		ReplCommand{".base", "[2|8|10|16]", "show or set the base whole numbers are shown in", calc.setBase},
+		quit,
+	)
+	repl.show = calc.showStack
+	repl.changed = calc.changed
+	return calc
+}
+
+// runCalc starts calculator mode, returning the status to exit with once it's
+// done.
+func runCalc(options Options) int {
+	words, err := loadStdLib(options.cache)
+	if err != nil {
+		printError(err, options)
+		return exitSoftware
+	}
+	return newCalculator(words, options).repl.loop(APP_NAME + " calc, type .help for help")
+}
+
+// changed remembers the stack from before an entry so it can be undone, and
+// names the entry's result if it left a new value on top.
+func (calc *Calculator) changed(before []Value, ok bool) {
+	values := calc.repl.state.values.Items()
+	recalled := calc.recalledDepth == len(values) && len(values) > 0 && values[len(values)-1] == calc.recalled
+	calc.recalledDepth = 0
+	if slices.Equal(before, values) {
+		return
+	}
+	calc.undo = append(calc.undo, calcSnapshot{before, len(calc.results)})
+	if len(calc.undo) > maxUndo {
+		calc.undo = calc.undo[1:]
+	}
+	if !ok || len(values) == 0 || recalled {
+		return
+	}
+	// a value left where it already was, like after `drop`, isn't a new result
+	if top := values[len(values)-1]; len(values) > len(before) || before[len(values)-1] != top {
+		calc.addResult(top)
+	}
+}
+
+// addResult names value `$n`, defining a word that pushes it again.
+func (calc *Calculator) addResult(value Value) {
+	calc.results = append(calc.results, value)
+	name := fmt.Sprintf("$%v", len(calc.results))
+	calc.repl.state.words.set(name, Word{builtin: func(state *EvalState) error {
+		state.values.Push(value)
+		calc.recalled, calc.recalledDepth = value, state.values.Len()
+		return nil
+	}})
+	fmt.Printf("%v = %v\n", name, calc.format(value))
+}
+
+func (calc *Calculator) undoChange(string) (int, bool) {
+	if len(calc.undo) == 0 {
+		fmt.Println("nothing to undo")
+		return 0, false
+	}
+	snapshot := calc.undo[len(calc.undo)-1]
+	calc.undo = calc.undo[:len(calc.undo)-1]
+	for i := snapshot.results; i < len(calc.results); i++ {
+		calc.repl.state.words.set(fmt.Sprintf("$%v", i+1), Word{})
+	}
+	calc.results = calc.results[:snapshot.results]
+	calc.repl.state.values = Stack[Value]{items: snapshot.values}
+	calc.showStack()
+	return 0, false
+}
+
+func (calc *Calculator) setPrecision(arg string) (int, bool) {
+	if arg == "auto" {
+		calc.precision = -1
+	} else if arg != "" {
+		digits, err := strconv.Atoi(arg)
+		if err != nil || digits < 0 || digits > 17 {
+			fmt.Println("precision should be a number of digits from 0 to 17, or auto")
+			return 0, false
+		}
+		calc.precision = digits
+	}
+	if calc.precision < 0 {
+		fmt.Println("precision: auto")
+	} else {
+		fmt.Printf("precision: %v\n", plural(calc.precision, "digit"))
+	}
+	return 0, false
+}
+
+func (calc *Calculator) setBase(arg string) (int, bool) {
+	if arg != "" {
+		base, err := strconv.Atoi(arg)
+		if _, ok := calcBases[base]; err != nil || !ok {
+			fmt.Println("base should be 2, 8, 10 or 16")
+			return 0, false
+		}
+		calc.base = base
+	}
+	fmt.Printf("base: %v\n", calc.base)
+	return 0, false
+}
+
+// showStack prints the stack one value to a line with the top at the bottom,
+// numbered by how far down each value is like on an RPN calculator.
+func (calc *Calculator) showStack() {
+	values := calc.repl.state.values.Items()
+	if len(values) == 0 {
+		fmt.Println("  (empty)")
+		return
+	}
+	shown := values[max(0, len(values)-maxStackShown):]
+	width := len(strconv.Itoa(len(shown)))
+	if len(shown) < len(values) {
+		fmt.Printf("  %*v  ...\n", width, "")
+	}
+	for i, value := range shown {
+		fmt.Printf("  %*v: %v\n", width, len(shown)-i, calc.format(value))
+	}
+}
+
+// format writes a value using the display settings. Whole numbers are shown
+// in the chosen base, and the rest with the chosen precision, so what's shown
+// can be typed back in.
+func (calc *Calculator) format(value Value) string {
+	number := value.number
+	switch {
+	case value.kind != ValueNumber, math.IsInf(number, 0), math.IsNaN(number):
+		return value.literal()
+	case calc.base != 10 && number == math.Trunc(number) && math.Abs(number) <= 1<<53:
+		sign := ""
+		if number < 0 {
+			sign, number = "-", -number
+		}
+		return sign + calcBases[calc.base] + strconv.FormatInt(int64(number), calc.base)
+	case calc.precision >= 0:
+		return strconv.FormatFloat(number, 'f', calc.precision, 64)
+	}
+	return formatNumber(number)
+}
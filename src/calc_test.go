@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// newTestCalc starts calculator mode with nothing to read, for entries to be
+// given to it one at a time.
+func newTestCalc(t *testing.T) *Calculator {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	words, err := loadStdLib(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newCalculator(words, Options{})
+}
+
+// enter runs each entry in turn, returning what the last one printed to
+// stdout.
+func enter(t *testing.T, calc *Calculator, entries ...string) string {
+	t.Helper()
+	output := ""
+	for _, entry := range entries {
+		_, output, _ = runCommand(t, func() int {
+			status, _ := calc.repl.enter(entry)
+			return status
+		})
+	}
+	return output
+}
+
+func TestCalcResults(t *testing.T) {
+	calc := newTestCalc(t)
+	tests := []struct {
+		entry  string
+		output string
+	}{
+		{"2 3", "$1 = 3\n  2: 2\n  1: 3\n"},
+		{"+", "$2 = 5\n  1: 5\n"},
+		{"$1 10 *", "$3 = 30\n  2: 5\n  1: 30\n"},
+		// recalling a result doesn't name it again
+		{"$1", "  3: 5\n  2: 30\n  1: 3\n"},
+		{"$2 $3", "  5: 5\n  4: 30\n  3: 3\n  2: 5\n  1: 30\n"},
+		{"1 +", "$4 = 31\n  5: 5\n  4: 30\n  3: 3\n  2: 5\n  1: 31\n"},
+		// nor does dropping a value to uncover one that was there already
+		{"drop", "  4: 5\n  3: 30\n  2: 3\n  1: 5\n"},
+		{"$4", "  5: 5\n  4: 30\n  3: 3\n  2: 5\n  1: 31\n"},
+	}
+	for _, test := range tests {
+		if got := enter(t, calc, test.entry); got != test.output {
+			t.Errorf("%q printed %q, want %q", test.entry, got, test.output)
+		}
+	}
+}
+
+func TestCalcUndo(t *testing.T) {
+	calc := newTestCalc(t)
+	enter(t, calc, "2 3", "+", "$1")
+	if got, want := enter(t, calc, ".undo"), "  1: 5\n"; got != want {
+		t.Errorf("undoing a recall printed %q, want %q", got, want)
+	}
+	if got, want := enter(t, calc, ".undo"), "  2: 2\n  1: 3\n"; got != want {
+		t.Errorf("undoing `+` printed %q, want %q", got, want)
+	}
+	if _, ok := calc.repl.state.words.lookup("$2"); ok {
+		t.Errorf("$2 is still defined after undoing the entry that made it")
+	}
+	if got, want := enter(t, calc, "*"), "$2 = 6\n  1: 6\n"; got != want {
+		t.Errorf("the next result printed %q, want %q", got, want)
+	}
+	enter(t, calc, ".undo", ".undo")
+	if got, want := enter(t, calc, ".undo"), "nothing to undo\n"; got != want {
+		t.Errorf("undoing past the start printed %q, want %q", got, want)
+	}
+	// a failed entry can be undone too, putting back what it popped
+	enter(t, calc, "1 2", `"x" +`)
+	if got, want := enter(t, calc, ".undo"), "  2: 1\n  1: 2\n"; got != want {
+		t.Errorf("undoing a failed entry printed %q, want %q", got, want)
+	}
+}
+
+func TestCalcSettings(t *testing.T) {
+	calc := newTestCalc(t)
+	tests := []struct {
+		entry  string
+		output string
+	}{
+		{".precision", "precision: auto\n"},
+		{".precision 2", "precision: 2 digits\n"},
+		{"1 3 /", "$1 = 0.33\n  1: 0.33\n"},
+		{".precision 18", "precision should be a number of digits from 0 to 17, or auto\n"},
+		{".precision -1", "precision should be a number of digits from 0 to 17, or auto\n"},
+		{".precision auto", "precision: auto\n"},
+		{".base", "base: 10\n"},
+		{".base 16", "base: 16\n"},
+		{"drop 255", "$2 = 0xff\n  1: 0xff\n"},
+		{"-1 *", "$3 = -0xff\n  1: -0xff\n"},
+		{".base 3", "base should be 2, 8, 10 or 16\n"},
+		{".base 2", "base: 2\n"},
+		{"drop 5", "$4 = 0b101\n  1: 0b101\n"},
+	}
+	for _, test := range tests {
+		if got := enter(t, calc, test.entry); got != test.output {
+			t.Errorf("%q printed %q, want %q", test.entry, got, test.output)
+		}
+	}
+}
+
+func TestCalcFormat(t *testing.T) {
+	tests := []struct {
+		value     Value
+		precision int
+		base      int
+		want      string
+	}{
+		{Value{kind: ValueNumber, number: 0.1}, -1, 10, "0.1"},
+		{Value{kind: ValueNumber, number: 2.0 / 3}, 3, 10, "0.667"},
+		{Value{kind: ValueNumber, number: 5}, 2, 10, "5.00"},
+		{Value{kind: ValueNumber, number: 10}, -1, 8, "0o12"},
+		{Value{kind: ValueNumber, number: 1.5}, -1, 16, "1.5"},
+		{Value{kind: ValueNumber, number: 1.5}, 0, 16, "2"},
+		{Value{kind: ValueNumber, number: 1 << 60}, -1, 16, "1152921504606847000"},
+		{Value{kind: ValueNumber, number: math.Inf(-1)}, 2, 16, "-inf"},
+		{Value{kind: ValueText, text: "a\"b"}, 2, 16, `"a\"b"`},
+	}
+	for _, test := range tests {
+		calc := &Calculator{precision: test.precision, base: test.base}
+		if got := calc.format(test.value); got != test.want {
+			t.Errorf("%v with precision %v in base %v shown as %q, want %q", test.value.literal(), test.precision, test.base, got, test.want)
+		}
+	}
+	// what's shown can be typed back in
+	for _, base := range []int{2, 8, 16} {
+		calc := &Calculator{precision: -1, base: base}
+		shown := calc.format(Value{kind: ValueNumber, number: -42})
+		if number, err := parseNumber(shown); err != nil || number != -42 {
+			t.Errorf("%q read back as %v (%v)", shown, number, err)
+		}
+	}
+}
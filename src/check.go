@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EffectOut is a value left on the stack by a word: either a new value of the
+// given type or, when from isn't -1, one of the word's inputs passed through.
+type EffectOut struct {
+	typ  StackType
+	from int
+}
+
+// Effect is the stack effect of a word, with values listed bottom to top.
+type Effect struct {
+	inputs  []StackType
+	outputs []EffectOut
+}
+
+func (effect *Effect) String() string {
+	names := make([]string, 0, len(effect.inputs))
+	parts := []string{"("}
+	for i, typ := range effect.inputs {
+		names = append(names, slotName(i))
+		parts = append(parts, names[i]+typ.suffix())
+	}
+	parts = append(parts, "--")
+	fresh := len(names)
+	for _, out := range effect.outputs {
+		if out.from >= 0 {
+			parts = append(parts, names[out.from]+out.typ.suffix())
+			continue
+		}
+		parts = append(parts, slotName(fresh)+out.typ.suffix())
+		fresh++
+	}
+	parts = append(parts, ")")
+	return strings.Join(parts, " ")
+}
+
+func slotName(i int) string {
+	if i < 26 {
+		return string(rune('a' + i))
+	}
+	return fmt.Sprintf("x%v", i)
+}
+
+// shuffles maps the stack builtins to the inputs their outputs come from, as
+// their metadata can't say which value ends up where.
+var shuffles = map[string][]int{
+	"dup":  {0, 0},
+	"swap": {1, 0},
+	"rot":  {2, 0, 1},
+}
+
+func builtinEffect(builtin Builtin) *Effect {
+	effect := &Effect{inputs: parseStackTypes(builtin.inputs)}
+	if from, ok := shuffles[builtin.name]; ok {
+		for _, i := range from {
+			effect.outputs = append(effect.outputs, EffectOut{effect.inputs[i], i})
+		}
+		return effect
+	}
+	for _, typ := range parseStackTypes(builtin.outputs) {
+		effect.outputs = append(effect.outputs, EffectOut{typ, -1})
+	}
+	return effect
+}
+
+// Slot is a value on the checker's stack. Copies of a value share a slot, so
+// learning its type in one place tells every copy.
+type Slot struct {
+	typ StackType
+}
+
+func joinSlots(a, b *Slot) *Slot {
+	if a == b {
+		return a
+	} else if a.typ == b.typ {
+		return &Slot{a.typ}
+	}
+	return &Slot{TypeAny}
+}
+
+// CheckWord is a word as seen by the checker. The effect of a definition is
+// worked out the first time it's needed.
+type CheckWord struct {
+	name     string
+	token    *Token  // nil for builtins
+	effect   *Effect // nil if it can't be known ahead of time
+	reason   string  // why effect is nil
+	checked  bool
+	checking bool
+}
+
+func (word *CheckWord) String() string {
+	if word.effect == nil {
+		return fmt.Sprintf(": %v ( ? ) # %v", word.name, word.reason)
+	}
+	if word.token != nil && word.token.signature != nil {
+		return fmt.Sprintf(": %v %v", word.name, word.token.signature)
+	}
+	return fmt.Sprintf(": %v %v", word.name, word.effect)
+}
+
+// CheckFrame is the abstract stack of the code being checked.
+type CheckFrame struct {
+	stack       Stack[*Slot]
+	inputs      []*Slot // values taken from below the stack, topmost first
+	allowInputs bool    // false at the top level, where the stack starts empty
+	lost        string  // why the rest of the code can't be checked
+	interps     Stack[int]
+}
+
+// depth is the stack depth relative to where the frame started.
+func (frame *CheckFrame) depth() int {
+	return frame.stack.Len() - len(frame.inputs)
+}
+
+func (frame *CheckFrame) effect() *Effect {
+	effect := &Effect{}
+	for i := len(frame.inputs) - 1; i >= 0; i-- {
+		effect.inputs = append(effect.inputs, frame.inputs[i].typ)
+	}
+	for _, slot := range frame.stack.Items() {
+		out := EffectOut{slot.typ, -1}
+		for i, input := range frame.inputs {
+			if input == slot {
+				out.from = len(frame.inputs) - 1 - i
+			}
+		}
+		effect.outputs = append(effect.outputs, out)
+	}
+	return effect
+}
+
+// CheckState infers stack effects without running anything, reporting
+// underflows, type mismatches and unbalanced loops.
+type CheckState struct {
+	*Diagnostics
+	words   map[string]*CheckWord
+	defs    []*CheckWord // definitions in the order they were made
+	dynamic bool         // the script may define words the checker can't see
+	hoisted map[*Token]*CheckWord
+	frame   *CheckFrame
+}
+
+func newCheckState(maxErrors int) *CheckState {
+	state := &CheckState{
+		Diagnostics: &Diagnostics{maxErrors: maxErrors},
+		words:       make(map[string]*CheckWord),
+		hoisted:     make(map[*Token]*CheckWord),
+	}
+	builtins := append(append([]Builtin{}, Builtins...), GeneratedBuiltins...)
+	for _, builtin := range builtins {
+		word := &CheckWord{name: builtin.name, checked: true}
+		if builtin.dynamic {
+			word.reason = fmt.Sprintf("calls `%v`", builtin.name)
+		} else {
+			word.effect = builtinEffect(builtin)
+		}
+		state.words[builtin.name] = word
+	}
+	return state
+}
+
+func (state *CheckState) lose(format string, args ...any) {
+	state.frame.lost = fmt.Sprintf(format, args...)
+}
+
+func (state *CheckState) expect(token *Token, what string, slot *Slot, want StackType) {
+	if want == TypeAny || slot.typ == want {
+		return
+	} else if slot.typ == TypeAny {
+		slot.typ = want
+		return
+	}
+	state.ErrorAt(token, CodeTypeMismatch, "type mismatch: %v expects %v, got %v", what, want, slot.typ)
+}
+
+// pop takes values of the given types off the stack, bottom one first. Inside
+// a definition, running out of values means they come from the caller.
+func (state *CheckState) pop(token *Token, what string, types []StackType) []*Slot {
+	frame := state.frame
+	if !frame.allowInputs && frame.stack.Len() < len(types) {
+		state.ErrorAt(token, CodeUnderflow, "stack underflow: %v needs %v, found %v", what, plural(len(types), "value"), frame.stack.Len())
+	}
+	slots := make([]*Slot, len(types))
+	for i := len(types) - 1; i >= 0; i-- {
+		slot, ok := frame.stack.Pop()
+		if !ok {
+			slot = &Slot{TypeAny}
+			if frame.allowInputs {
+				frame.inputs = append(frame.inputs, slot)
+			}
+		}
+		state.expect(token, what, slot, types[i])
+		slots[i] = slot
+	}
+	return slots
+}
+
+func (state *CheckState) apply(token *Token, what string, effect *Effect) {
+	slots := state.pop(token, what, effect.inputs)
+	for _, out := range effect.outputs {
+		if out.from >= 0 {
+			state.frame.stack.Push(slots[out.from])
+		} else {
+			state.frame.stack.Push(&Slot{out.typ})
+		}
+	}
+}
+
+func (state *CheckState) effectOf(word *CheckWord) *Effect {
+	if !word.checked && !word.checking {
+		state.checkDef(word)
+	}
+	return word.effect
+}
+
+// checkDef works out the effect of a definition from its body. One with a
+// declared signature is checked against it instead, and always has that effect.
+func (state *CheckState) checkDef(word *CheckWord) {
+	saved := state.frame
+	state.frame = &CheckFrame{allowInputs: true}
+	sig := word.token.signature
+	if sig != nil {
+		for _, param := range sig.inputs {
+			state.frame.stack.Push(&Slot{param.typ})
+		}
+	}
+	word.checking = true
+	state.checkBody(word.token)
+	word.checking, word.checked = false, true
+	if sig != nil {
+		if state.frame.lost == "" {
+			state.checkSignature(word)
+		}
+	} else if state.frame.lost != "" {
+		word.reason = state.frame.lost
+	} else {
+		word.effect = state.frame.effect()
+	}
+	state.frame = saved
+}
+
+func (state *CheckState) checkSignature(word *CheckWord) {
+	frame, def, sig := state.frame, word.token, word.token.signature
+	if len(frame.inputs) > 0 {
+		state.ErrorAt(def, CodeSignature, "`%v` takes more values than the %v it declares", word.name, plural(len(sig.inputs), "input"))
+		return
+	}
+	slots := frame.stack.Items()
+	if len(slots) != len(sig.outputs) {
+		state.ErrorAt(def, CodeSignature, "`%v` should leave %v (%v), but leaves %v", word.name, plural(len(sig.outputs), "value"), paramNames(sig.outputs), len(slots))
+		return
+	}
+	for i, param := range sig.outputs {
+		if param.typ != TypeAny && slots[i].typ != TypeAny && slots[i].typ != param.typ {
+			state.ErrorAt(def, CodeSignature, "`%v` declares output `%v` as %v, got %v", word.name, param.name, param.typ, slots[i].typ)
+		}
+	}
+}
+
+func (state *CheckState) checkWord(token *Token) {
+	name := token.value.text
+	word, ok := state.words[name]
+	if !ok {
+		if state.dynamic {
+			state.lose("calls `%v`, which may be defined while running", name)
+			return
+		}
+		names := make([]string, 0, len(state.words))
+		for name := range state.words {
+			names = append(names, name)
+		}
+		state.report(&CheckError{*diagnosticAt(token, CodeUndefined, "undefined word: `%v`", name).withSuggestion(name, names)})
+		state.lose("calls undefined word `%v`", name)
+		return
+	}
+	if word.checking && word.effect == nil {
+		state.lose("calls `%v` recursively", name)
+		return
+	}
+	effect := state.effectOf(word)
+	if effect == nil {
+		if word.token != nil {
+			state.lose("calls `%v`, which %v", name, word.reason)
+		} else {
+			state.lose("%v", word.reason)
+		}
+		return
+	}
+	state.apply(token, fmt.Sprintf("`%v`", name), effect)
+}
+
+// checkLoop requires the body to leave the stack as it found it, plus a new
+// condition on top, so the stack looks the same however many times it runs.
+func (state *CheckState) checkLoop(token *Token) {
+	frame := state.frame
+	condition := []StackType{TypeNumber}
+	state.pop(token, "loop", condition)
+	entry := append([]*Slot{}, frame.stack.Items()...)
+	depth, inputs := frame.depth(), len(frame.inputs)
+	state.checkBody(token)
+	if frame.lost != "" {
+		return
+	}
+	if change := frame.depth() - depth; change != 1 {
+		state.ErrorAt(token, CodeUnbalancedLoop, "loop body is not stack-balanced: it should leave 1 value for the next condition, but changes the stack depth by %+d", change)
+		state.lose("has an unbalanced loop")
+		return
+	}
+	state.pop(token, "loop condition", condition)
+	// values the body took from the caller were there all along if it never ran
+	before := []*Slot{}
+	for i := len(frame.inputs) - 1; i >= inputs; i-- {
+		before = append(before, frame.inputs[i])
+	}
+	before = append(before, entry...)
+	after := frame.stack.Items()
+	for i := range after {
+		after[i] = joinSlots(before[i], after[i])
+	}
+}
+
+func (state *CheckState) checkToken(token *Token) {
+	frame := state.frame
+	switch token.kind {
+	case TokenNumber:
+		frame.stack.Push(&Slot{TypeNumber})
+	case TokenString:
+		frame.stack.Push(&Slot{TypeText})
+	case TokenWord:
+		state.checkWord(token)
+	case TokenDef:
+		state.define(token)
+	case TokenLoop:
+		state.checkLoop(token)
+	case TokenInterpBegin:
+		holes := make([]StackType, int(token.value.number))
+		state.pop(token, "interpolated string", holes)
+		frame.interps.Push(frame.depth())
+	case TokenInterpAppend:
+		depth, _ := frame.interps.Peek()
+		if frame.depth() != depth+1 {
+			state.ErrorAt(token, CodeInterp, "`%v` should push exactly one value into the interpolated string", token.value.text)
+			state.lose("has a malformed interpolated string")
+			return
+		}
+		frame.stack.Pop()
+	case TokenInterpEnd:
+		frame.interps.Pop()
+		frame.stack.Push(&Slot{TypeText})
+	}
+}
+
+func (state *CheckState) checkBody(token *Token) {
+	for i := range token.children {
+		child := &token.children[i]
+		// definitions can still be checked on their own once the stack is lost
+		if state.frame.lost == "" || child.kind == TokenDef {
+			state.checkToken(child)
+		}
+	}
+}
+
+func (state *CheckState) define(token *Token) {
+	word, ok := state.hoisted[token]
+	if !ok {
+		word = &CheckWord{name: token.value.text, token: token}
+		if token.signature != nil {
+			word.effect = token.signature.effect()
+		}
+		state.defs = append(state.defs, word)
+	}
+	state.words[word.name] = word
+}
+
+// hoist defines the first definition of each name at the top of a script
+// before checking it, as the interpreter does.
+func (state *CheckState) hoist(root *Token) {
+	seen := make(map[string]bool)
+	for i := range root.children {
+		def := &root.children[i]
+		if def.kind != TokenDef || seen[def.value.text] {
+			continue
+		}
+		seen[def.value.text] = true
+		state.define(def)
+		state.hoisted[def] = state.words[def.value.text]
+	}
+}
+
+// usesDynamic reports whether anything under token calls a builtin that
+// can define words while running.
+func (state *CheckState) usesDynamic(token *Token) bool {
+	for i := range token.children {
+		child := &token.children[i]
+		if child.kind == TokenWord {
+			if word, ok := state.words[child.value.text]; ok && word.token == nil && word.effect == nil {
+				return true
+			}
+		}
+		if state.usesDynamic(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkScript checks the top level of a script, then any definitions it made
+// that were never called.
+func (state *CheckState) checkScript(root *Token) {
+	state.dynamic = state.dynamic || state.usesDynamic(root)
+	state.frame = &CheckFrame{}
+	state.hoist(root)
+	state.checkBody(root)
+	for _, word := range state.defs {
+		if !word.checked {
+			state.checkDef(word)
+		}
+	}
+}
+
+func check(parseState ParseState, options Options) (defs []*CheckWord, err error) {
+	stdlib := parse(lex("stdlib", strings.NewReader(STDLIB), 0))
+	if stdlib.err != nil {
+		return nil, stdlib.err
+	}
+	state := newCheckState(options.maxErrors)
+	state.checkScript(stdlib.root)
+	state.defs = nil
+	state.checkScript(parseState.root)
+	return state.defs, state.result()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkSource(source string) ([]*CheckWord, error) {
+	return check(parse(lex("test.w", strings.NewReader(source), 0)), Options{})
+}
+
+func TestCheckEffects(t *testing.T) {
+	tests := []struct {
+		source string
+		effect string
+	}{
+		{": f ;", ": f ( -- )"},
+		{": f 1 ;", ": f ( -- a:f )"},
+		{`: f "x" ;`, ": f ( -- a:s )"},
+		{": f dup * ;", ": f ( a:f -- b:f )"},
+		{": f dup ;", ": f ( a -- a a )"},
+		{": f swap ;", ": f ( a b -- b a )"},
+		{": f drop drop ;", ": f ( a b -- )"},
+		{": g 1 + ; : f g g ;", ": f ( a:f -- b:f )"},
+		{": f dup 0 > { 1 - dup 0 > } ;", ": f ( a:f -- b:f )"},
+		{": f f ;", ": f ( ? ) # calls `f` recursively"},
+		{`: f "1" runstring ;`, ": f ( ? ) # calls `runstring`"},
+		// declared signatures are shown as written
+		{": f ( n:f -- m:f ) 2 * ;", ": f ( n:f -- m:f )"},
+	}
+	for _, test := range tests {
+		defs, err := checkSource(test.source)
+		if err != nil {
+			t.Errorf("%q failed: %v", test.source, err)
+		} else if got := defs[len(defs)-1].String(); got != test.effect {
+			t.Errorf("%q checked as %q, want %q", test.source, got, test.effect)
+		}
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		codes  []ErrorCode
+	}{
+		{"1 +", []ErrorCode{CodeUnderflow}},
+		{`1 "x" +`, []ErrorCode{CodeTypeMismatch}},
+		{": f 1 + ; \"x\" f", []ErrorCode{CodeTypeMismatch}},
+		{"typo", []ErrorCode{CodeUndefined}},
+		{"1 { 1 1 }", []ErrorCode{CodeUnbalancedLoop}},
+		{": f ( a:f -- ) drop 1 ;", []ErrorCode{CodeSignature}},
+		{": f ( a:f -- b:f ) ; \"x\" f", []ErrorCode{CodeTypeMismatch}},
+		// checking goes on after an error, and past code it can't follow
+		{"1 + typo", []ErrorCode{CodeUnderflow, CodeUndefined}},
+		{`"1" runstring 1 +`, nil},
+	}
+	for _, test := range tests {
+		_, err := checkSource(test.source)
+		codes := []ErrorCode{}
+		for _, err := range unwrapErrors(err) {
+			codes = append(codes, errorCode(err))
+		}
+		if strings.Join(codeStrings(codes), " ") != strings.Join(codeStrings(test.codes), " ") {
+			t.Errorf("%q failed with %v (%v), want %v", test.source, codes, err, test.codes)
+		}
+	}
+}
@@ -1,11 +1,29 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
 
 func isDigit(char byte) bool {
 	return char >= '0' && char <= '9'
 }
 
+func isBinaryDigit(char byte) bool {
+	return char == '0' || char == '1'
+}
+
+func isOctalDigit(char byte) bool {
+	return char >= '0' && char <= '7'
+}
+
+func isHexDigit(char byte) bool {
+	return isDigit(char) || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')
+}
+
 func isWordChar(char byte) bool {
 	return (char >= '!' && char < '\\') ||
 		(char > '\\' && char <= '~')
@@ -15,6 +33,36 @@ func isWhitespace(char byte) bool {
 	return char == ' ' || char == '\t' || char == '\r'
 }
 
+// isWordRune extends isWordChar to the rest of Unicode, so letters and
+// symbols like `π` or `→` can be used in word names.
+func isWordRune(char rune) bool {
+	if char < unicode.MaxASCII {
+		return isWordChar(byte(char))
+	}
+	return unicode.IsGraphic(char) && !unicode.IsSpace(char)
+}
+
+func isWhitespaceRune(char rune) bool {
+	if char < unicode.MaxASCII {
+		return isWhitespace(byte(char))
+	}
+	return unicode.IsSpace(char)
+}
+
+// cutString splits text around the first instance of sep, like strings.Cut
+// without the flag saying whether it was found.
+func cutString(text, sep string) (string, string) {
+	before, after, _ := strings.Cut(text, sep)
+	return before, after
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("%v %v", count, noun)
+	}
+	return fmt.Sprintf("%v %vs", count, noun)
+}
+
 func boolToFloat(from bool) float64 {
 	if from {
 		return 1
@@ -27,35 +75,93 @@ func floatToBool(to float64) bool {
 }
 
 func (state *EvalState) printv(value Value) {
-	str := value.text
-	if value.kind == ValueNumber {
-		str = fmt.Sprint(value.number)
+	str := value.String()
+	if len(str) > 0 {
+		state.lastPrintedWasNewline = str[len(str)-1] == '\n'
 	}
-	state.lastPrintedWasNewline = str[len(str)-1] == '\n'
 	fmt.Print(str)
 }
 
-func (state *LexState) Error(format string, args ...any) bool {
-	msg := fmt.Sprintf(format, args...)
-	state.err = fmt.Errorf("%s:%d:%d: %s", state.file, state.line+1, state.index-state.lastLineIdx+1, msg)
+// Diagnostics collects the errors reported by the lexer and parser, which
+// carry on after an error until they have found maxErrors of them.
+type Diagnostics struct {
+	errs      []error
+	maxErrors int
+}
+
+var errTooManyErrors = errors.New("too many errors")
+
+func (diags *Diagnostics) report(err error) {
+	if diags.full() {
+		return
+	}
+	diags.errs = append(diags.errs, err)
+	if diags.full() {
+		diags.errs = append(diags.errs, errTooManyErrors)
+	}
+}
+
+func (diags *Diagnostics) full() bool {
+	return diags.maxErrors > 0 && len(diags.errs) >= diags.maxErrors
+}
+
+func (diags *Diagnostics) result() error {
+	return errors.Join(diags.errs...)
+}
+
+func (state *LexState) Error(code ErrorCode, format string, args ...any) bool {
+	return state.ErrorAt(state.pos(), code, format, args...)
+}
+
+func (state *LexState) ErrorAt(pos lexPos, code ErrorCode, format string, args ...any) bool {
+	diag := newDiagnostic(code, state.file, pos.line, state.column(pos), format, args...)
+	state.report(&LexError{*diag.to(state.line, state.column(state.pos()))})
+	return true
+}
+
+func (state *ParseState) Error(code ErrorCode, format string, args ...any) bool {
+	diag := newDiagnostic(code, state.file, state.line, state.col, format, args...)
+	state.report(&ParseError{*diag.to(state.endLine, state.endCol)})
 	return true
 }
 
-func (state *ParseState) Error(format string, args ...any) bool {
-	msg := fmt.Sprintf(format, args...)
-	state.err = fmt.Errorf("%s:%d:%d: %s", state.file, state.line+1, state.col+1, msg)
+func (state *ParseState) ErrorAt(token *Token, code ErrorCode, format string, args ...any) bool {
+	state.report(&ParseError{*diagnosticAt(token, code, format, args...)})
 	return true
 }
 
-func (state *EvalState) Error(format string, args ...any) bool {
-	token := state.currentToken()
-	msg := fmt.Sprintf(format, args...)
-	state.err = fmt.Errorf("%s:%d:%d: %s", token.file, token.line+1, token.col+1, msg)
+func (state *CheckState) ErrorAt(token *Token, code ErrorCode, format string, args ...any) bool {
+	state.report(&CheckError{*diagnosticAt(token, code, format, args...)})
 	return true
 }
 
-func (lexeme *Lexeme) Error(format string, args ...any) bool {
-	msg := fmt.Sprintf(format, args...)
-	lexeme.state.err = fmt.Errorf("%s:%d:%d: %s", lexeme.file, lexeme.line+1, lexeme.col+1, msg)
+func (state *EvalState) Error(code ErrorCode, format string, args ...any) bool {
+	return state.ErrorAt(state.currentToken(), code, format, args...)
+}
+
+func (state *EvalState) ErrorAt(token *Token, code ErrorCode, format string, args ...any) bool {
+	state.fail(diagnosticAt(token, code, format, args...))
+	return true
+}
+
+// fail stops the script with an error, adding a backtrace to it.
+func (state *EvalState) fail(diag *Diagnostic) {
+	diag.trace = state.backtrace()
+	state.err = &RuntimeError{*diag}
+}
+
+func (state *EvalState) Warning(code ErrorCode, format string, args ...any) {
+	state.WarningAt(state.currentToken(), code, format, args...)
+}
+
+func (state *EvalState) WarningAt(token *Token, code ErrorCode, format string, args ...any) {
+	diag := diagnosticAt(token, code, format, args...)
+	diag.warning = true
+	printDiagnostics(os.Stderr, &RuntimeError{*diag}, state.options.errorFormat)
+}
+
+func (lexeme *Lexeme) Error(code ErrorCode, format string, args ...any) bool {
+	diag := newDiagnostic(code, lexeme.file, lexeme.line, lexeme.col, format, args...)
+	lexeme.state.report(&LexError{*diag.to(lexeme.endLine, lexeme.endCol)})
 	return true
 }
@@ -0,0 +1,100 @@
+package main
+
+type Op int
+
+const (
+	OpPush Op = iota
+	OpCall
+	OpDefine
+	OpLoop
+	OpJump
+	OpInterpBegin
+	OpInterpAppend
+	OpInterpHole
+	OpInterpEnd
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPush:
+		return "push"
+	case OpCall:
+		return "call"
+	case OpDefine:
+		return "define"
+	case OpLoop:
+		return "loop"
+	case OpJump:
+		return "jump"
+	case OpInterpBegin:
+		return "interp-begin"
+	case OpInterpAppend:
+		return "interp-append"
+	case OpInterpHole:
+		return "interp-hole"
+	case OpInterpEnd:
+		return "interp-end"
+	}
+	return "unknown"
+}
+
+type Instr struct {
+	op    Op
+	arg   int    // word slot, jump target or count, depending on op
+	value Value  // pushed by OpPush
+	token *Token // where the instruction came from, for errors
+}
+
+// Code is the flat form of a token's children run by the VM. Loops become
+// jumps, and words are called by their dictionary slot.
+type Code struct {
+	instrs []Instr
+	words  *Dictionary // the dictionary the slots belong to
+}
+
+func (code *Code) emit(op Op, arg int, token *Token) *Instr {
+	code.instrs = append(code.instrs, Instr{op: op, arg: arg, token: token})
+	return &code.instrs[len(code.instrs)-1]
+}
+
+// compile returns the code for a token's body, compiling it the first time.
+// Definitions nested inside are compiled separately, when they're first called.
+// Slots are only meaningful to one dictionary, so a tree run against another
+// is compiled again.
+func (state *EvalState) compile(token *Token) *Code {
+	if token.code == nil || token.code.words != state.words {
+		code := &Code{words: state.words}
+		state.compileBody(code, token)
+		token.code = code
+	}
+	return token.code
+}
+
+func (state *EvalState) compileBody(code *Code, token *Token) {
+	for i := range token.children {
+		child := &token.children[i]
+		switch child.kind {
+		case TokenNumber, TokenString:
+			code.emit(OpPush, 0, child).value = child.value
+		case TokenWord:
+			code.emit(OpCall, state.words.slot(child.value.text), child)
+		case TokenDef:
+			code.emit(OpDefine, 0, child)
+		case TokenLoop:
+			// the loop checks its condition, runs the body, then jumps back
+			head := len(code.instrs)
+			code.emit(OpLoop, 0, child)
+			state.compileBody(code, child)
+			code.emit(OpJump, head, child)
+			code.instrs[head].arg = len(code.instrs)
+		case TokenInterpBegin:
+			code.emit(OpInterpBegin, int(child.value.number), child)
+		case TokenInterpAppend:
+			code.emit(OpInterpAppend, 0, child)
+		case TokenInterpHole:
+			code.emit(OpInterpHole, int(child.value.number), child)
+		case TokenInterpEnd:
+			code.emit(OpInterpEnd, 0, child)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Label points at another place in a script that helps explain a diagnostic,
+// like where an unclosed loop was opened.
+type Label struct {
+	file    string
+	line    int
+	col     int
+	endLine int
+	endCol  int
+	text    string
+}
+
+// ErrorCode identifies a kind of problem, so tools can recognise it without
+// matching on the message.
+type ErrorCode string
+
+const (
+	// lexing
+	CodeBadCharacter ErrorCode = "E0101" // a character that can't start a token, or invalid UTF-8
+	CodeUnterminated ErrorCode = "E0102" // a comment or string that never ends
+	CodeBadNumber    ErrorCode = "E0103" // a malformed number
+	CodeBadEscape    ErrorCode = "E0104" // an unknown or malformed escape sequence
+	CodeMissingSpace ErrorCode = "E0105" // a token running straight into the next one
+	CodeBadString    ErrorCode = "E0106" // a malformed interpolated string or heredoc
+	// parsing
+	CodeNumberRange     ErrorCode = "E0201" // a number too big for a float
+	CodeMissingName     ErrorCode = "E0202" // a definition without a name
+	CodeUnclosed        ErrorCode = "E0203" // a definition or loop that's never closed
+	CodeUnexpectedClose ErrorCode = "E0204" // a `;` or `}` with nothing to close
+	CodeBadSignature    ErrorCode = "E0205" // a malformed stack-effect comment
+	CodeBadLexeme       ErrorCode = "E0206" // something the parser doesn't expect from the lexer
+	// checking and running
+	CodeUndefined      ErrorCode = "E0301" // a word that isn't defined
+	CodeUnderflow      ErrorCode = "E0302" // not enough values on the stack
+	CodeTypeMismatch   ErrorCode = "E0303" // a value of the wrong kind
+	CodeSignature      ErrorCode = "E0304" // a definition not doing what its signature says
+	CodeRedefine       ErrorCode = "E0305" // redefining a builtin
+	CodeForget         ErrorCode = "E0306" // forgetting something that can't be forgotten
+	CodeInterp         ErrorCode = "E0307" // misusing the stack inside an interpolated string
+	CodeBuiltinFailed  ErrorCode = "E0308" // a builtin failing, like `loadfile` on a missing file
+	CodeUnbalancedLoop ErrorCode = "E0309" // a loop body that changes the stack depth
+	// warnings
+	CodeRedefineWarning ErrorCode = "W0305"
+)
+
+// Diagnostic is an error or warning at a place in a script. Error gives the
+// plain one-line form, while a Renderer shows it with the source around it.
+// It's wrapped by the error types below, one for each stage that reports
+// errors.
+type Diagnostic struct {
+	code    ErrorCode
+	file    string
+	line    int
+	col     int
+	endLine int // where the span pointed at ends, just past its last rune
+	endCol  int
+	message string
+	warning bool
+	labels  []Label
+	notes   []string // shown after the source, each starting with "note:" or "help:"
+	trace   []string // the backtrace of a runtime error
+}
+
+// LexError is a problem found while splitting a script into lexemes.
+type LexError struct{ Diagnostic }
+
+// ParseError is a problem with how a script's lexemes fit together.
+type ParseError struct{ Diagnostic }
+
+// CheckError is a problem found by `wafer check` without running anything.
+type CheckError struct{ Diagnostic }
+
+// RuntimeError is a problem found while loading or running a script, or a
+// warning about one.
+type RuntimeError struct{ Diagnostic }
+
+// asDiagnostic finds the diagnostic in err, if it has one, along with the
+// stage that reported it.
+func asDiagnostic(err error) (*Diagnostic, string, bool) {
+	var lexErr *LexError
+	var parseErr *ParseError
+	var checkErr *CheckError
+	var runtimeErr *RuntimeError
+	switch {
+	case errors.As(err, &lexErr):
+		return &lexErr.Diagnostic, "lex", true
+	case errors.As(err, &parseErr):
+		return &parseErr.Diagnostic, "parse", true
+	case errors.As(err, &checkErr):
+		return &checkErr.Diagnostic, "check", true
+	case errors.As(err, &runtimeErr):
+		return &runtimeErr.Diagnostic, "runtime", true
+	}
+	return nil, "", false
+}
+
+// newDiagnostic makes a diagnostic pointing at a single rune, which to can
+// widen.
+func newDiagnostic(code ErrorCode, file string, line, col int, format string, args ...any) *Diagnostic {
+	return &Diagnostic{code: code, file: file, line: line, col: col, endLine: line, endCol: col + 1, message: fmt.Sprintf(format, args...)}
+}
+
+func diagnosticAt(token *Token, code ErrorCode, format string, args ...any) *Diagnostic {
+	return newDiagnostic(code, token.file, token.line, token.col, format, args...).to(token.endLine, token.endCol)
+}
+
+// to makes the diagnostic cover everything up to endLine and endCol, unless
+// that isn't past where it starts, as for tokens the lexer didn't make.
+func (diag *Diagnostic) to(endLine, endCol int) *Diagnostic {
+	if spans(diag.line, diag.col, endLine, endCol) {
+		diag.endLine, diag.endCol = endLine, endCol
+	}
+	return diag
+}
+
+func spans(line, col, endLine, endCol int) bool {
+	return endLine > line || (endLine == line && endCol > col)
+}
+
+func (diag *Diagnostic) withLabel(token *Token, format string, args ...any) *Diagnostic {
+	return diag.withLabelAt(token.file, token.line, token.col, token.endLine, token.endCol, format, args...)
+}
+
+func (diag *Diagnostic) withLabelAt(file string, line, col, endLine, endCol int, format string, args ...any) *Diagnostic {
+	if !spans(line, col, endLine, endCol) {
+		endLine, endCol = line, col+1
+	}
+	diag.labels = append(diag.labels, Label{file, line, col, endLine, endCol, fmt.Sprintf(format, args...)})
+	return diag
+}
+
+func (diag *Diagnostic) withHelp(format string, args ...any) *Diagnostic {
+	diag.notes = append(diag.notes, "help: "+fmt.Sprintf(format, args...))
+	return diag
+}
+
+// withSuggestion suggests the closest of names to a misspelt one, if any is
+// close enough.
+func (diag *Diagnostic) withSuggestion(name string, names []string) *Diagnostic {
+	if match, ok := closestName(name, names); ok {
+		diag.withHelp("did you mean `%v`?", match)
+	}
+	return diag
+}
+
+func (diag *Diagnostic) Error() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s:%d:%d: ", diag.file, diag.line+1, diag.col+1)
+	if diag.warning {
+		out.WriteString("warning: ")
+	}
+	out.WriteString(diag.message)
+	for _, frame := range diag.trace {
+		out.WriteString("\n\t")
+		out.WriteString(frame)
+	}
+	return out.String()
+}
+
+// editDistance counts the single-rune insertions, deletions, substitutions
+// and swaps of neighbouring runes needed to turn one string into another.
+func editDistance(from, to string) int {
+	a, b := []rune(from), []rune(to)
+	dist := make([][]int, len(a)+1)
+	for i := range dist {
+		dist[i] = make([]int, len(b)+1)
+		dist[i][0] = i
+	}
+	for j := range dist[0] {
+		dist[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			dist[i][j] = min(dist[i-1][j]+1, dist[i][j-1]+1, dist[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				dist[i][j] = min(dist[i][j], dist[i-2][j-2]+1)
+			}
+		}
+	}
+	return dist[len(a)][len(b)]
+}
+
+// closestName finds the name nearest to a misspelt one, allowing about one
+// mistake for every three runes. Names too short to have anything left after
+// the mistakes, like `x` for `*`, don't count.
+func closestName(name string, names []string) (string, bool) {
+	length := len([]rune(name))
+	best, bestDistance := "", max(1, length/3)+1
+	for _, candidate := range names {
+		distance := editDistance(name, candidate)
+		if distance >= length || distance >= len([]rune(candidate)) {
+			continue
+		} else if distance < bestDistance || (distance == bestDistance && best != "" && candidate < best) {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best, best != ""
+}
+
+// scriptSources holds the text of scripts that aren't files, so their
+// diagnostics can still show source lines.
+var scriptSources = map[string]string{"stdlib": STDLIB}
+
+// ErrorFormat picks how errors and warnings are printed: for people, with
+// source snippets, or as JSON for editors and CI.
+type ErrorFormat int
+
+const (
+	ErrorFormatHuman ErrorFormat = iota
+	ErrorFormatJSON
+)
+
+func (format ErrorFormat) String() string {
+	switch format {
+	case ErrorFormatHuman:
+		return "human"
+	case ErrorFormatJSON:
+		return "json"
+	}
+	return "unknown"
+}
+
+func parseErrorFormat(text string) (ErrorFormat, error) {
+	for _, format := range []ErrorFormat{ErrorFormatHuman, ErrorFormatJSON} {
+		if format.String() == text {
+			return format, nil
+		}
+	}
+	return ErrorFormatHuman, fmt.Errorf("unknown error format `%v`", text)
+}
+
+// Renderer prints diagnostics in the style of rustc, with the lines they
+// point at underlined, or as JSON.
+type Renderer struct {
+	out     io.Writer
+	format  ErrorFormat
+	color   bool
+	sources map[string][]string
+}
+
+func newRenderer(out *os.File, format ErrorFormat) *Renderer {
+	return &Renderer{out: out, format: format, color: useColor(out), sources: make(map[string][]string)}
+}
+
+// printDiagnostics prints every error or warning in err.
+func printDiagnostics(out *os.File, err error, format ErrorFormat) {
+	newRenderer(out, format).Print(err)
+}
+
+// useColor reports whether out is a terminal, unless NO_COLOR is set.
+func useColor(out *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := out.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	colorError   = "\x1b[1;31m"
+	colorWarning = "\x1b[1;33m"
+	colorLabel   = "\x1b[1;34m"
+	colorBold    = "\x1b[1m"
+	colorReset   = "\x1b[0m"
+)
+
+func (r *Renderer) paint(color, text string) string {
+	if !r.color {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// line returns a line of a script, if it can be found.
+func (r *Renderer) line(file string, line int) (string, bool) {
+	lines, ok := r.sources[file]
+	if !ok {
+		text, known := scriptSources[file]
+		if !known {
+			if source, err := os.ReadFile(file); err == nil {
+				text, known = string(source), true
+			}
+		}
+		// a script that can't be found has no lines to show
+		if known {
+			lines = strings.Split(text, "\n")
+		}
+		r.sources[file] = lines
+	}
+	if line < 0 || line >= len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[line], "\r"), true
+}
+
+// Print renders every diagnostic in err, which may be several joined
+// together. Other errors are printed as they are.
+func (r *Renderer) Print(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			r.Print(err)
+		}
+		return
+	}
+	diag, kind, ok := asDiagnostic(err)
+	switch {
+	case r.format == ErrorFormatJSON:
+		r.renderJSON(diag, kind, err)
+	case ok:
+		r.render(diag)
+	default:
+		fmt.Fprintln(r.out, err)
+	}
+}
+
+type jsonLabel struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"end_line"`
+	EndColumn int    `json:"end_column"`
+	Message   string `json:"message"`
+}
+
+// jsonDiagnostic is how a diagnostic is printed with --error-format=json, one
+// to a line. Lines and columns start at 1, and the end is just past the last
+// rune of what's pointed at. Errors that aren't about a place in a script only
+// have a severity and a message.
+type jsonDiagnostic struct {
+	Severity  string      `json:"severity"`
+	Code      ErrorCode   `json:"code,omitempty"`
+	Kind      string      `json:"kind,omitempty"`
+	Message   string      `json:"message"`
+	File      string      `json:"file,omitempty"`
+	Line      int         `json:"line,omitempty"`
+	Column    int         `json:"column,omitempty"`
+	EndLine   int         `json:"end_line,omitempty"`
+	EndColumn int         `json:"end_column,omitempty"`
+	Labels    []jsonLabel `json:"labels,omitempty"`
+	Notes     []string    `json:"notes,omitempty"`
+	Backtrace []string    `json:"backtrace,omitempty"`
+}
+
+func (r *Renderer) renderJSON(diag *Diagnostic, kind string, err error) {
+	out := jsonDiagnostic{Severity: "error", Message: err.Error()}
+	if diag != nil {
+		out = jsonDiagnostic{
+			Severity:  "error",
+			Code:      diag.code,
+			Kind:      kind,
+			Message:   diag.message,
+			File:      diag.file,
+			Line:      diag.line + 1,
+			Column:    diag.col + 1,
+			EndLine:   diag.endLine + 1,
+			EndColumn: diag.endCol + 1,
+			Notes:     diag.notes,
+			Backtrace: diag.trace,
+		}
+		if diag.warning {
+			out.Severity = "warning"
+		}
+		for _, label := range diag.labels {
+			out.Labels = append(out.Labels, jsonLabel{label.file, label.line + 1, label.col + 1, label.endLine + 1, label.endCol + 1, label.text})
+		}
+	}
+	// file names like `<runstring 1>` are left as they are
+	encoder := json.NewEncoder(r.out)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(out)
+}
+
+// mark is something to underline in a snippet: the diagnostic itself, or one
+// of its labels.
+type mark struct {
+	line    int
+	col     int
+	endLine int
+	endCol  int
+	text    string
+	primary bool
+}
+
+func (r *Renderer) render(diag *Diagnostic) {
+	var out strings.Builder
+	if diag.warning {
+		out.WriteString(r.paint(colorWarning, fmt.Sprintf("warning[%v]", diag.code)))
+	} else {
+		out.WriteString(r.paint(colorError, fmt.Sprintf("error[%v]", diag.code)))
+	}
+	out.WriteString(r.paint(colorBold, ": "+diag.message) + "\n")
+
+	// labels in other files get snippets of their own
+	files := []string{diag.file}
+	marks := map[string][]mark{diag.file: {{diag.line, diag.col, diag.endLine, diag.endCol, "", true}}}
+	for _, label := range diag.labels {
+		if _, ok := marks[label.file]; !ok {
+			files = append(files, label.file)
+		}
+		marks[label.file] = append(marks[label.file], mark{label.line, label.col, label.endLine, label.endCol, label.text, false})
+	}
+	width := 1
+	for _, file := range files {
+		for _, mark := range marks[file] {
+			width = max(width, len(fmt.Sprint(mark.line+1)))
+		}
+	}
+	gutter := strings.Repeat(" ", width)
+	for i, file := range files {
+		arrow := "-->"
+		if i > 0 {
+			arrow = ":::"
+		}
+		first := marks[file][0]
+		fmt.Fprintf(&out, "%v%v %v:%v:%v\n", gutter, r.paint(colorLabel, arrow), file, first.line+1, first.col+1)
+		r.snippet(&out, file, marks[file], width)
+	}
+	for _, note := range diag.notes {
+		kind, text, _ := strings.Cut(note, ": ")
+		fmt.Fprintf(&out, "%v %v %v: %v\n", gutter, r.paint(colorLabel, "="), r.paint(colorBold, kind), text)
+	}
+	for _, frame := range diag.trace {
+		fmt.Fprintf(&out, "%v %v %v: %v\n", gutter, r.paint(colorLabel, "="), r.paint(colorBold, "note"), frame)
+	}
+	out.WriteString("\n")
+	fmt.Fprint(r.out, out.String())
+}
+
+// snippet prints the lines of file that marks point at, each followed by its
+// underlines.
+func (r *Renderer) snippet(out *strings.Builder, file string, marks []mark, width int) {
+	marks = slices.Clone(marks)
+	slices.SortStableFunc(marks, func(a, b mark) int {
+		if a.line != b.line {
+			return a.line - b.line
+		}
+		return a.col - b.col
+	})
+	bar := r.paint(colorLabel, strings.Repeat(" ", width)+" |")
+	shown := false
+	prev := -1
+	for i, m := range marks {
+		source, ok := r.line(file, m.line)
+		if !ok {
+			continue
+		}
+		if !shown {
+			out.WriteString(bar + "\n")
+			shown = true
+		}
+		if m.line != prev {
+			if prev >= 0 && m.line > prev+1 {
+				out.WriteString(r.paint(colorLabel, "...") + "\n")
+			}
+			number := fmt.Sprintf("%*d |", width, m.line+1)
+			fmt.Fprintf(out, "%v %v\n", r.paint(colorLabel, number), expandTabs(source))
+			prev = m.line
+		}
+		runes := []rune(source)
+		col := min(m.col, len(runes))
+		underline, color := "^", colorError
+		if !m.primary {
+			underline, color = "-", colorLabel
+		}
+		// spans running onto later lines are underlined to the end of this one
+		end := len(runes)
+		if m.endLine == m.line {
+			end = min(m.endCol, end)
+		}
+		underline = strings.Repeat(underline, max(1, displayWidth(runes[col:max(col, end)])))
+		if m.text != "" {
+			underline += " " + m.text
+		}
+		fmt.Fprintf(out, "%v %v%v\n", bar, strings.Repeat(" ", displayWidth(runes[:col])), r.paint(color, underline))
+		if i == len(marks)-1 {
+			out.WriteString(bar + "\n")
+		}
+	}
+}
+
+const tabWidth = 4
+
+func expandTabs(line string) string {
+	return strings.ReplaceAll(line, "\t", strings.Repeat(" ", tabWidth))
+}
+
+func displayWidth(runes []rune) int {
+	width := 0
+	for _, c := range runes {
+		if c == '\t' {
+			width += tabWidth
+		} else {
+			width++
+		}
+	}
+	return width
+}
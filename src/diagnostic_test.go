@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// addSource makes source the text of file for as long as the test runs, so
+// its diagnostics can show it.
+func addSource(t *testing.T, file, source string) {
+	t.Helper()
+	scriptSources[file] = source
+	t.Cleanup(func() { delete(scriptSources, file) })
+}
+
+// renderError renders err without colour, the way it would be printed.
+func renderError(err error, format ErrorFormat) string {
+	var out strings.Builder
+	(&Renderer{out: &out, format: format, sources: make(map[string][]string)}).Print(err)
+	return out.String()
+}
+
+// sourceError is the error source stops with, whether parsing or running it.
+func sourceError(t *testing.T, file, source string) error {
+	t.Helper()
+	addSource(t, file, source)
+	parseState := parse(lex(file, strings.NewReader(source), 0))
+	if parseState.err != nil {
+		return parseState.err
+	}
+	words, err := loadStdLib(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() {
+		err = eval(parseState, words, Options{}).err
+	})
+	return err
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"underline", "1 2 swapp", `
+error[E0301]: undefined word: ` + "`swapp`" + `
+ --> a.w:1:5
+  |
+1 | 1 2 swapp
+  |     ^^^^^
+  |
+  = help: did you mean ` + "`swap`" + `?
+
+`},
+		{"labels", "1 {\n  dup\n;", `
+error[E0204]: unexpected end of definition
+ --> a.w:3:1
+  |
+1 | 1 {
+  |   - loop opened here
+...
+3 | ;
+  | ^
+  |
+
+error[E0203]: unclosed loop, expected ` + "`}`" + ` before end of file
+ --> a.w:1:3
+  |
+1 | 1 {
+  |   ^
+  |
+
+`},
+		{"tabs", "\t\"x\" 1 +", `
+error[E0303]: type error: ` + "`+`" + ` expected number, got text
+ --> a.w:1:8
+  |
+1 |     "x" 1 +
+  |           ^
+  |
+
+`},
+		{"backtrace", ": f 1 + ;\n\"x\" f", `
+error[E0303]: type error: ` + "`+`" + ` expected number, got text
+ --> a.w:1:7
+  |
+1 | : f 1 + ;
+  |       ^
+  |
+  = note: in ` + "`f`" + `, called from a.w:2:5
+
+`},
+	}
+	for _, test := range tests {
+		got := renderError(sourceError(t, "a.w", test.source), ErrorFormatHuman)
+		if want := strings.TrimPrefix(test.want, "\n"); got != want {
+			t.Errorf("%v: rendered\n%v\nwant\n%v", test.name, got, want)
+		}
+	}
+}
+
+// TestRenderUnknownSource checks that a diagnostic in a script that can't be
+// found is still shown, without its source.
+func TestRenderUnknownSource(t *testing.T) {
+	err := &RuntimeError{*newDiagnostic(CodeUndefined, "/no/such/file.w", 4, 2, "undefined word: `x`")}
+	want := "error[E0301]: undefined word: `x`\n --> /no/such/file.w:5:3\n\n"
+	if got := renderError(err, ErrorFormatHuman); got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+}
+
+func TestRenderColor(t *testing.T) {
+	var out strings.Builder
+	renderer := &Renderer{out: &out, color: true, sources: make(map[string][]string)}
+	renderer.Print(sourceError(t, "a.w", "1 2 swapp"))
+	for _, want := range []string{colorError + "error[E0301]" + colorReset, colorError + "^^^^^" + colorReset} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("rendered %q, want it to contain %q", out.String(), want)
+		}
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	names := []string{"swap", "dup", "drop", "over", "strlen", "strconcat", "*"}
+	tests := []struct {
+		name string
+		want string // empty if nothing is close enough
+	}{
+		{"swapp", "swap"},
+		{"dpu", "dup"},
+		{"strln", "strlen"},
+		{"srtconcat", "strconcat"},
+		{"x", ""},
+		{"frobnicate", ""},
+	}
+	for _, test := range tests {
+		got, ok := closestName(test.name, names)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("closestName(%q) = %q, %v, want %q", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"labels", sourceError(t, "a.w", "1 {\n;"), `{"severity":"error","code":"E0204","kind":"parse","message":"unexpected end of definition","file":"a.w","line":2,"column":1,"end_line":2,"end_column":2,"labels":[{"file":"a.w","line":1,"column":3,"end_line":1,"end_column":4,"message":"loop opened here"}]}
+{"severity":"error","code":"E0203","kind":"parse","message":"unclosed loop, expected ` + "`}`" + ` before end of file","file":"a.w","line":1,"column":3,"end_line":1,"end_column":4}
+`},
+		{"notes", sourceError(t, "a.w", "1 2 swapp"), `{"severity":"error","code":"E0301","kind":"runtime","message":"undefined word: ` + "`swapp`" + `","file":"a.w","line":1,"column":5,"end_line":1,"end_column":10,"notes":["help: did you mean ` + "`swap`" + `?"]}
+`},
+		{"backtrace", sourceError(t, "a.w", ": f 1 + ;\n\"x\" f"), `{"severity":"error","code":"E0303","kind":"runtime","message":"type error: ` + "`+`" + ` expected number, got text","file":"a.w","line":1,"column":7,"end_line":1,"end_column":8,"backtrace":["in ` + "`f`" + `, called from a.w:2:5"]}
+`},
+		// names like <stdin> aren't escaped as if for HTML
+		{"escaping", sourceError(t, "<a&b>", "1 <"), `{"severity":"error","code":"E0302","kind":"runtime","message":"stack underflow: ` + "`<`" + ` needs 2 values, found 1","file":"<a&b>","line":1,"column":3,"end_line":1,"end_column":4}
+`},
+		{"plain", errors.New("failed to read file"), `{"severity":"error","message":"failed to read file"}
+`},
+	}
+	for _, test := range tests {
+		if got := renderError(test.err, ErrorFormatJSON); got != test.want {
+			t.Errorf("%v: rendered\n%v\nwant\n%v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import "fmt"
+
+type RedefinePolicy int
+
+const (
+	RedefineAllow RedefinePolicy = iota
+	RedefineWarn
+	RedefineForbid
+)
+
+func (policy RedefinePolicy) String() string {
+	switch policy {
+	case RedefineAllow:
+		return "allow"
+	case RedefineWarn:
+		return "warn"
+	case RedefineForbid:
+		return "forbid"
+	}
+	return "unknown"
+}
+
+func parseRedefinePolicy(text string) (RedefinePolicy, error) {
+	for _, policy := range []RedefinePolicy{RedefineAllow, RedefineWarn, RedefineForbid} {
+		if policy.String() == text {
+			return policy, nil
+		}
+	}
+	return RedefineAllow, fmt.Errorf("unknown redefinition policy `%v`", text)
+}
+
+// Dictionary gives every word name a slot, so compiled code can refer to a
+// word by its slot and still see it when it's redefined or forgotten.
+type Dictionary struct {
+	slots map[string]int
+	words []Word // the zero Word in a slot means it's undefined
+}
+
+func newDictionary() *Dictionary {
+	return &Dictionary{slots: make(map[string]int)}
+}
+
+func (dict *Dictionary) slot(name string) int {
+	slot, ok := dict.slots[name]
+	if !ok {
+		slot = len(dict.words)
+		dict.slots[name] = slot
+		dict.words = append(dict.words, Word{})
+	}
+	return slot
+}
+
+func (dict *Dictionary) lookup(name string) (Word, bool) {
+	slot, ok := dict.slots[name]
+	if !ok {
+		return Word{}, false
+	}
+	word := dict.words[slot]
+	return word, word.defined()
+}
+
+func (dict *Dictionary) set(name string, word Word) {
+	dict.words[dict.slot(name)] = word
+}
+
+// names lists every word that's currently defined.
+func (dict *Dictionary) names() []string {
+	names := []string{}
+	for name, slot := range dict.slots {
+		if dict.words[slot].defined() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (word Word) defined() bool {
+	return word.token != nil || word.builtin != nil
+}
+
+// Definition records a word added to the dictionary at runtime, along with
+// whatever it shadowed, so it can be undone by `forget` or a marker.
+type Definition struct {
+	name string
+	prev Word
+}
+
+func (state *EvalState) define(name string, word Word) bool {
+	prev, _ := state.words.lookup(name)
+	if hoistedPrev, ok := state.hoisted[word.token]; ok {
+		// already checked, and what it shadowed was saved when it was hoisted
+		delete(state.hoisted, word.token)
+		prev = hoistedPrev
+	} else if !state.canRedefine(name, state.currentToken()) {
+		return false
+	}
+	state.history = append(state.history, Definition{name, prev})
+	state.words.set(name, word)
+	return true
+}
+
+func (state *EvalState) canRedefine(name string, at *Token) bool {
+	if state.isBuiltin(name) {
+		switch state.options.redefine {
+		case RedefineWarn:
+			state.WarningAt(at, CodeRedefineWarning, "redefining builtin `%v`", name)
+		case RedefineForbid:
+			state.ErrorAt(at, CodeRedefine, "cannot redefine builtin `%v`", name)
+			return false
+		}
+	}
+	return true
+}
+
+// hoist makes the first definition of each name at the top of a script usable
+// before the script starts. It's still recorded where it's made, so markers
+// and forget treat it as being defined there.
+func (state *EvalState) hoist(root *Token) bool {
+	seen := make(map[string]bool)
+	for i := range root.children {
+		def := &root.children[i]
+		if def.kind != TokenDef || seen[def.value.text] {
+			continue
+		}
+		seen[def.value.text] = true
+		if !state.canRedefine(def.value.text, def) {
+			return false
+		}
+		state.hoisted[def], _ = state.words.lookup(def.value.text)
+		state.words.set(def.value.text, Word{token: def})
+	}
+	return true
+}
+
+// checkUndefined reports every word used in a script that is neither defined
+// yet nor defined anywhere in the script. `runstring` and `runfile` can define
+// words of their own, so words that might run after one of them are left for
+// when they're called. `marker` defines the word it's given, which is known
+// ahead of time when that's a string literal.
+func (state *EvalState) checkUndefined(root *Token) bool {
+	defs := make(map[string]bool)
+	var collect func(token *Token)
+	collect = func(token *Token) {
+		for i := range token.children {
+			child := &token.children[i]
+			if child.kind == TokenDef {
+				defs[child.value.text] = true
+			} else if name, ok := markerName(token, i); ok {
+				defs[name] = true
+			}
+			collect(child)
+		}
+	}
+	collect(root)
+	names := state.words.names()
+	for name := range defs {
+		names = append(names, name)
+	}
+	// definitions can be called at any time, so if anything can define words
+	// none of their bodies are checked
+	dynamic := definesWords(root)
+	diags := Diagnostics{maxErrors: state.options.maxErrors}
+	// check reports undefined words under token, until it reaches something
+	// that might define more, and reports whether it did
+	var check func(token *Token) bool
+	check = func(token *Token) bool {
+		for i := range token.children {
+			child := &token.children[i]
+			switch {
+			case child.kind == TokenDef:
+				if !dynamic {
+					check(child)
+				}
+			case child.kind == TokenLoop && definesWords(child):
+				// later trips round the loop come after it
+				return true
+			case child.kind == TokenWord:
+				if _, ok := state.words.lookup(child.value.text); !ok && !defs[child.value.text] {
+					diags.report(&RuntimeError{*diagnosticAt(child, CodeUndefined, "undefined word: `%v`", child.value.text).withSuggestion(child.value.text, names)})
+				}
+				if definesWord(token, i) {
+					return true
+				}
+			default:
+				if check(child) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	check(root)
+	state.err = diags.result()
+	return state.err == nil
+}
+
+// markerName returns the name token.children[i] defines if it's a call to
+// `marker` straight after a string literal.
+func markerName(token *Token, i int) (string, bool) {
+	child := &token.children[i]
+	if i == 0 || child.kind != TokenWord || child.value.text != "marker" || token.children[i-1].kind != TokenString {
+		return "", false
+	}
+	return token.children[i-1].value.text, true
+}
+
+// definesWord reports whether token.children[i] might define words that can't
+// be known ahead of time.
+func definesWord(token *Token, i int) bool {
+	child := &token.children[i]
+	if child.kind != TokenWord {
+		return false
+	}
+	switch child.value.text {
+	case "runstring", "runfile":
+		return true
+	case "marker":
+		_, ok := markerName(token, i)
+		return !ok
+	}
+	return false
+}
+
+// definesWords reports whether anything under token might define words that
+// can't be known ahead of time.
+func definesWords(token *Token) bool {
+	for i := range token.children {
+		if definesWord(token, i) || definesWords(&token.children[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load gets a script ready to run: its definitions are hoisted and every word
+// it uses must exist, apart from any that might be defined while it runs.
+func (state *EvalState) load(root *Token) bool {
+	if !state.hoist(root) {
+		return false
+	}
+	return state.checkUndefined(root)
+}
+
+// isBuiltin reports whether name currently refers to a word provided by the
+// interpreter rather than one defined by a script.
+func (state *EvalState) isBuiltin(name string) bool {
+	word, _ := state.words.lookup(name)
+	return word.primitive
+}
+
+// forget removes the latest definition of name and everything defined after it.
+func (state *EvalState) forget(name string) bool {
+	for i := len(state.history) - 1; i >= 0; i-- {
+		if state.history[i].name == name {
+			state.rollback(i)
+			return true
+		}
+	}
+	if state.isBuiltin(name) {
+		state.Error(CodeForget, "cannot forget builtin `%v`", name)
+	} else if _, ok := state.words.lookup(name); ok {
+		state.Error(CodeForget, "cannot forget `%v`: not a user definition", name)
+	} else {
+		state.Error(CodeUndefined, "cannot forget `%v`: undefined word", name)
+	}
+	return false
+}
+
+// rollback undoes every definition made since the history had length mark.
+func (state *EvalState) rollback(mark int) {
+	for i := len(state.history) - 1; i >= mark; i-- {
+		def := state.history[i]
+		state.words.set(def.name, def.prev)
+	}
+	state.history = state.history[:mark]
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+// TestIsBuiltin checks a name only counts as a builtin while it still refers
+// to the interpreter's own word, which forget and markers can bring back.
+func TestIsBuiltin(t *testing.T) {
+	tests := []struct {
+		source  string
+		name    string
+		builtin bool
+	}{
+		{``, "swap", true},
+		{``, "twice", false},
+		{``, "nothing", false},
+		{`: swap ;`, "swap", false},
+		{`: swap ; : swap ;`, "swap", false},
+		{`: swap ; "swap" forget`, "swap", true},
+		{`"mark" marker : swap ; mark`, "swap", true},
+		{`"swap" marker`, "swap", false},
+		{`"mark" marker`, "mark", false},
+	}
+	for _, test := range tests {
+		state := runState(t, test.source, Options{redefine: RedefineAllow})
+		if state.err != nil {
+			t.Fatalf("%q failed: %v", test.source, state.err)
+		}
+		if got := state.isBuiltin(test.name); got != test.builtin {
+			t.Errorf("after %q, isBuiltin(%q) = %v, want %v", test.source, test.name, got, test.builtin)
+		}
+	}
+}
+
+func TestRedefineForbidden(t *testing.T) {
+	tests := []struct {
+		source string
+		code   ErrorCode
+	}{
+		{`: swap ;`, CodeRedefine},
+		{`"swap" marker`, CodeRedefine},
+		{`"mark" marker : mark ;`, ""},
+		{`: twice 2 * ; : twice 3 * ;`, ""},
+	}
+	for _, engine := range engines {
+		for _, test := range tests {
+			_, err := runSource(t, test.source, Options{redefine: RedefineForbid, engine: engine})
+			if code := errorCode(err); code != test.code {
+				t.Errorf("%v: %q failed with %q (%v), want %q", engine, test.source, code, err, test.code)
+			}
+		}
+	}
+}
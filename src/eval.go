@@ -1,41 +1,193 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Scope is a body being run: a token's children for the tree walker, or the
+// token's compiled code for the VM.
 type Scope struct {
 	token *Token
+	code  *Code
 	index int
+	base  int    // stack depth below the inputs a definition declares
+	call  *Token // what entered this scope, or nil for the script itself
+}
+
+// frame describes a scope for a backtrace. Loops and the script itself aren't
+// frames of their own.
+func (scope *Scope) frame() (string, bool) {
+	call := scope.call
+	if call == nil || scope.token.kind == TokenLoop {
+		return "", false
+	}
+	at := fmt.Sprintf("%s:%d:%d", call.file, call.line+1, call.col+1)
+	if scope.token.kind == TokenRoot {
+		return fmt.Sprintf("in code run by `%v`, called from %v", call.value.text, at), true
+	}
+	return fmt.Sprintf("in `%v`, called from %v", scope.token.value.text, at), true
 }
 
+// inlinedFrames adds a frame to frames for each call token was inlined from,
+// standing in for the scopes it would have run in.
+func inlinedFrames(token *Token, frames []string) []string {
+	if token == nil {
+		return frames
+	}
+	for _, call := range token.inlined {
+		frames = append(frames, fmt.Sprintf("in `%v`, called from %s:%d:%d", call.value.text, call.file, call.line+1, call.col+1))
+	}
+	return frames
+}
+
+// maxBacktrace is how many frames a backtrace shows before leaving out the
+// middle, which is mostly the same few words when something recurses.
+const maxBacktrace = 20
+
 type Word struct {
 	token   *Token
 	builtin Proc
+	// set for the interpreter's own builtins, but not for procs made while
+	// running, like markers
+	primitive bool
+}
+
+// Interp is an interpolated string being built, holding the values taken off
+// the stack for its `{}` holes. The string stays here until it's finished, so
+// the words in its `{word}` segments can't see it.
+type Interp struct {
+	holes []Value
+	text  strings.Builder
+	depth int // stack depth once the holes have been taken
+}
+
+type Options struct {
+	redefine    RedefinePolicy
+	maxErrors   int
+	engine      Engine
+	cache       bool // whether to cache parsed scripts
+	errorFormat ErrorFormat
 }
 
 type EvalState struct {
 	scopes                Stack[*Scope]
 	err                   error
 	root                  *Token
-	words                 map[string]Word
+	words                 *Dictionary
+	history               []Definition
+	hoisted               map[*Token]Word // hoisted definitions not yet reached, and what they shadowed
 	values                Stack[Value]
+	interps               Stack[*Interp]
+	options               Options
 	lastPrintedWasNewline bool
 }
 
 func (state *EvalState) pushScope(token *Token) {
-	state.scopes.Push(&Scope{token, 0})
+	base := state.values.Len()
+	if token.signature != nil {
+		base -= len(token.signature.inputs)
+	}
+	scope := &Scope{token: token, base: base, call: state.currentToken()}
+	if state.options.engine == EngineVM {
+		scope.code = state.compile(token)
+	}
+	state.scopes.Push(scope)
+}
+
+// popScope leaves the current scope, checking its outputs first so any error
+// is reported from inside it.
+func (state *EvalState) popScope() {
+	scope, _ := state.scopes.Peek()
+	if scope.token.signature != nil {
+		state.checkOutputs(scope)
+	}
+	state.scopes.Pop()
+}
+
+// backtrace lists the definitions being run, innermost first, with where each
+// was called from.
+func (state *EvalState) backtrace() []string {
+	frames := inlinedFrames(state.currentToken(), []string{})
+	scopes := state.scopes.Items()
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if frame, ok := scopes[i].frame(); ok {
+			frames = append(frames, frame)
+		}
+		frames = inlinedFrames(scopes[i].call, frames)
+	}
+	if len(frames) > maxBacktrace {
+		left := len(frames) - maxBacktrace
+		frames = append(append(frames[:maxBacktrace/2:maxBacktrace/2],
+			fmt.Sprintf("... %v ...", plural(left, "more frame"))), frames[len(frames)-maxBacktrace/2:]...)
+	}
+	return frames
+}
+
+// checkInputs makes sure the stack holds what a definition declares it takes.
+func (state *EvalState) checkInputs(name string, sig *Signature) bool {
+	values := state.values.Items()
+	if len(values) < len(sig.inputs) {
+		missing := sig.inputs[len(sig.inputs)-len(values)-1]
+		state.Error(CodeUnderflow, "`%v` is missing input `%v`: it takes %v, found %v", name, missing.name, plural(len(sig.inputs), "value"), len(values))
+		return false
+	}
+	values = values[len(values)-len(sig.inputs):]
+	for i, param := range sig.inputs {
+		if !param.typ.accepts(values[i].kind) {
+			state.Error(CodeTypeMismatch, "`%v` expects input `%v` to be %v, got %v", name, param.name, param.typ, values[i].kind)
+			return false
+		}
+	}
+	return true
+}
+
+// checkOutputs makes sure a definition that has just returned left what it
+// declares on the stack.
+func (state *EvalState) checkOutputs(scope *Scope) bool {
+	def, sig := scope.token, scope.token.signature
+	left := state.values.Len() - scope.base
+	var diag *Diagnostic
+	if left < 0 {
+		diag = diagnosticAt(def, CodeSignature, "`%v` takes more values than the %v it declares", def.value.text, plural(len(sig.inputs), "input"))
+	} else if left != len(sig.outputs) {
+		diag = diagnosticAt(def, CodeSignature, "`%v` should leave %v (%v), but leaves %v", def.value.text, plural(len(sig.outputs), "value"), paramNames(sig.outputs), left)
+	} else {
+		values := state.values.Items()[scope.base:]
+		for i, param := range sig.outputs {
+			if !param.typ.accepts(values[i].kind) {
+				diag = diagnosticAt(def, CodeSignature, "`%v` declares output `%v` as %v, got %v", def.value.text, param.name, param.typ, values[i].kind)
+				break
+			}
+		}
+	}
+	if diag == nil {
+		return true
+	} else if scope.call != nil {
+		diag.withLabel(scope.call, "called here")
+	}
+	state.fail(diag)
+	return false
 }
 
-func newEvalState(parseState ParseState, defaultWords map[string]Word) EvalState {
+func newEvalState(parseState ParseState, defaultWords *Dictionary, options Options) EvalState {
 	state := EvalState{
 		scopes:                Stack[*Scope]{},
 		err:                   parseState.err,
 		root:                  parseState.root,
 		words:                 defaultWords,
+		history:               make([]Definition, 0),
+		hoisted:               make(map[*Token]Word),
 		values:                Stack[Value]{},
+		interps:               Stack[*Interp]{},
+		options:               options,
 		lastPrintedWasNewline: true,
 	}
 	state.pushScope(state.root)
 	builtins := append(Builtins, GeneratedBuiltins...)
 	for _, builtin := range builtins {
-		state.words[builtin.name] = Word{builtin: builtin.proc}
+		state.words.set(builtin.name, Word{builtin: builtin.proc, primitive: true})
 	}
 	return state
 }
@@ -44,75 +196,175 @@ func (state *EvalState) currentToken() *Token {
 	scope, ok := state.scopes.Peek()
 	if !ok {
 		return nil
+	} else if scope.code != nil {
+		if scope.index >= len(scope.code.instrs) {
+			return nil
+		}
+		return scope.code.instrs[scope.index].token
 	} else if scope.index >= len(scope.token.children) {
 		return nil
 	}
 	return &scope.token.children[scope.index]
 }
 
+// The helpers below are shared by the tree walker and the VM, so the two
+// engines behave the same and report the same errors.
+
+// call runs a word, or enters its definition in a new scope.
+func (state *EvalState) call(name string, word Word) bool {
+	if word.token != nil {
+		if sig := word.token.signature; sig != nil && !state.checkInputs(name, sig) {
+			return false
+		}
+		state.pushScope(word.token)
+		return true
+	} else if word.builtin != nil {
+		if err := word.builtin(state); err != nil {
+			if state.err == nil {
+				state.builtinError(name, err)
+			}
+			return false
+		}
+		return true
+	}
+	state.fail(diagnosticAt(state.currentToken(), CodeUndefined, "undefined word: `%v`", name).withSuggestion(name, state.words.names()))
+	return false
+}
+
+// builtinError reports why the builtin name failed, naming it in errors from
+// the pop helpers.
+func (state *EvalState) builtinError(name string, err error) {
+	var underflow *underflowError
+	var mismatch *typeError
+	switch {
+	case errors.As(err, &underflow):
+		state.Error(CodeUnderflow, "stack underflow: `%v` needs %v, found %v", name, plural(underflow.needs, "value"), underflow.found)
+	case errors.As(err, &mismatch):
+		state.Error(CodeTypeMismatch, "type error: `%v` expected %v, got %v", name, mismatch.expected, mismatch.got)
+	default:
+		state.Error(CodeBuiltinFailed, "`%v`: %v", name, err)
+	}
+}
+
+// loopCondition pops the value deciding whether a loop body runs (again).
+func (state *EvalState) loopCondition() (run bool, ok bool) {
+	val, ok := state.values.Peek()
+	if !ok {
+		state.Error(CodeUnderflow, "empty stack")
+		return false, false
+	}
+	if val.kind != ValueNumber {
+		state.Error(CodeTypeMismatch, "loop cond should be number, got `%v`", val.kind)
+		return false, false
+	}
+	state.values.Drop(1)
+	return val.number != 0, true
+}
+
+func (state *EvalState) beginInterp(count int) bool {
+	if state.values.Len() < count {
+		state.Error(CodeUnderflow, "interpolated string needs %v, found %v", plural(count, "value"), state.values.Len())
+		return false
+	}
+	holes := make([]Value, count)
+	for i := count - 1; i >= 0; i-- {
+		holes[i], _ = state.values.Pop()
+	}
+	state.interps.Push(&Interp{holes: holes, depth: state.values.Len()})
+	return true
+}
+
+// appendWord appends the value pushed by the word name to the interpolated
+// string being built.
+func (state *EvalState) appendWord(name string) bool {
+	interp, _ := state.interps.Peek()
+	if state.values.Len() != interp.depth+1 {
+		state.Error(CodeInterp, "`%v` should push exactly one value into the interpolated string", name)
+		return false
+	}
+	value, _ := state.values.Pop()
+	interp.text.WriteString(value.String())
+	return true
+}
+
+func (state *EvalState) appendHole(index int) {
+	interp, _ := state.interps.Peek()
+	interp.text.WriteString(interp.holes[index].String())
+}
+
+// endInterp pushes the finished string.
+func (state *EvalState) endInterp() {
+	interp, _ := state.interps.Pop()
+	state.values.Push(Value{kind: ValueText, text: interp.text.String()})
+}
+
 func (state *EvalState) step() {
 	scope, ok := state.scopes.Peek()
 	if !ok {
 		return
 	} else if scope.index >= len(scope.token.children) {
-		state.scopes.Pop()
+		state.popScope()
 		return
 	}
-	token := scope.token.children[scope.index]
+	token := &scope.token.children[scope.index]
 	switch token.kind {
-	case TokenNumber:
+	case TokenNumber, TokenString:
 		state.values.Push(token.value)
-		scope.index++
-		return
-	case TokenString:
-		state.values.Push(token.value)
-		scope.index++
-		return
 	case TokenWord:
-		word, ok := state.words[token.value.text]
-		if !ok {
-			state.Error("undefined word: `%v`", token.value.text)
+		word, _ := state.words.lookup(token.value.text)
+		if !state.call(token.value.text, word) {
 			return
 		}
-		if word.token != nil {
-			state.pushScope(word.token)
-		} else if word.builtin != nil {
-			if !word.builtin(state) {
-				state.Error("builtin failed: `%v`", token.value.text)
-				return
-			}
-		} else {
-			state.Error("malformed word entry: `%v`", token.value.text)
+	case TokenDef:
+		if !state.define(token.value.text, Word{token: token}) {
 			return
 		}
-		scope.index++
-		return
-	case TokenDef:
-		state.words[token.value.text] = Word{token: &token}
-		scope.index++
-		return
 	case TokenLoop:
-		val, ok := state.values.Pop()
+		run, ok := state.loopCondition()
 		if !ok {
-			state.Error("empty stack")
+			return
+		} else if run {
+			state.pushScope(token)
 			return
 		}
-		if val.kind != ValueNumber {
-			state.Error("loop cond should be number, got `%v`", val.kind)
+	case TokenInterpBegin:
+		if !state.beginInterp(int(token.value.number)) {
 			return
 		}
-		if val.number == 0 {
-			scope.index++
-		} else {
-			state.pushScope(&token)
+	case TokenInterpAppend:
+		if !state.appendWord(token.value.text) {
+			return
 		}
+	case TokenInterpHole:
+		state.appendHole(int(token.value.number))
+	case TokenInterpEnd:
+		state.endInterp()
+	}
+	scope.index++
+}
+
+func eval(parseState ParseState, defaultWords *Dictionary, options Options) (state EvalState) {
+	state = newEvalState(parseState, defaultWords, options)
+	if state.err != nil || !state.load(state.root) {
 		return
 	}
+	state.execute()
+	return
+}
+
+// evalNext runs another script once the first has finished, keeping the stack
+// and dictionary it left behind.
+func (state *EvalState) evalNext(root *Token) {
+	if state.load(root) {
+		state.pushScope(root)
+		state.execute()
+	}
 }
 
-func eval(parseState ParseState, defaultWords map[string]Word) (state EvalState) {
-	state = newEvalState(parseState, defaultWords)
-	if state.err != nil {
+// execute runs until every scope has finished or there's an error.
+func (state *EvalState) execute() {
+	if state.options.engine == EngineVM {
+		state.run()
 		return
 	}
 	for {
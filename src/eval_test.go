@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// captureStdout runs fn, returning what it printed.
+func captureStdout(t testing.TB, fn func()) string {
+	t.Helper()
+	read, write, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = write
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(read)
+		output <- string(data)
+	}()
+	func() {
+		defer func() {
+			os.Stdout = saved
+			write.Close()
+		}()
+		fn()
+	}()
+	return <-output
+}
+
+// runSource runs source with the standard library loaded, returning what it
+// printed and any error it stopped with.
+func runSource(t *testing.T, source string, options Options) (string, error) {
+	t.Helper()
+	return runOptimized(t, source, options, false)
+}
+
+// runOptimized is runSource, optimizing the script first if asked to.
+func runOptimized(t *testing.T, source string, options Options, optimizeScript bool) (string, error) {
+	t.Helper()
+	var err error
+	output := captureStdout(t, func() {
+		var words *Dictionary
+		if words, err = loadStdLib(false); err != nil {
+			return
+		}
+		parseState := parse(lex("test.w", strings.NewReader(source), 0))
+		if err = parseState.err; err != nil {
+			return
+		}
+		if optimizeScript {
+			optimize(parseState.root, words)
+		}
+		err = eval(parseState, words, options).err
+	})
+	return output, err
+}
+
+var engines = []Engine{EngineVM, EngineTree}
+
+// errorCode is the code of the diagnostic in err, if it's one.
+func errorCode(err error) ErrorCode {
+	if diag, _, ok := asDiagnostic(err); ok {
+		return diag.code
+	}
+	return ""
+}
+
+func TestInterpolation(t *testing.T) {
+	tests := []struct {
+		source string
+		output string
+		code   ErrorCode
+	}{
+		{`f"plain" print`, "plain", ""},
+		{`1 2 f"{} then {}" print`, "1 then 2", ""},
+		{`: five 5 ; f"v={five}" print`, "v=5", ""},
+		{`f"{{}}" print`, "{}", ""},
+		// words in segments see the stack as it was, not the string being built
+		{`5 f"v={dup}" print " " print print`, "v=5 5", ""},
+		{`5 f"v={drop}" print`, "", CodeInterp},
+		{`1 2 f"v={swap}" print`, "", CodeInterp},
+		{`f"{}" print`, "", CodeUnderflow},
+	}
+	for _, engine := range engines {
+		for _, test := range tests {
+			output, err := runSource(t, test.source, Options{engine: engine})
+			if code := errorCode(err); code != test.code {
+				t.Errorf("%v: %q failed with %q (%v), want %q", engine, test.source, code, err, test.code)
+			} else if output != test.output {
+				t.Errorf("%v: %q printed %q, want %q", engine, test.source, output, test.output)
+			}
+		}
+	}
+}
+
+func TestCheckInterpolation(t *testing.T) {
+	tests := []struct {
+		source string
+		code   ErrorCode
+	}{
+		{`: f ( -- s:s ) 5 f"v={dup}" swap drop ;`, ""},
+		{`: f 5 f"v={drop}" ;`, CodeInterp},
+		{`: f 1 2 f"v={swap}" ;`, CodeInterp},
+	}
+	for _, test := range tests {
+		_, err := check(parse(lex("test.w", strings.NewReader(test.source), 0)), Options{})
+		if code := errorCode(err); code != test.code {
+			t.Errorf("%q failed with %q (%v), want %q", test.source, code, err, test.code)
+		}
+	}
+}
+
+func TestUndefinedWords(t *testing.T) {
+	// anything printed means the undefined word was only found when reached
+	tests := []struct {
+		source string
+		output string
+	}{
+		{`"hi" print typo`, ""},
+		{`"hi" print typo "2" runstring`, ""},
+		{`"hi" print "2" runstring typo`, "hi"},
+		{`"hi" print "x" marker typo`, ""},
+		{`"hi" print "x" forget typo`, ""},
+		{`"hi" print : f typo ;`, ""},
+		{`"hi" print : f typo ; "2" runstring f`, "hi"},
+		{`"hi" print 1 { typo "2" runstring 0 }`, "hi"},
+		{`"hi" print "name" dup marker runstring typo`, "hi"},
+	}
+	for _, test := range tests {
+		output, err := runSource(t, test.source, Options{})
+		if code := errorCode(err); code != CodeUndefined {
+			t.Errorf("%q failed with %q (%v), want %q", test.source, code, err, CodeUndefined)
+		} else if output != test.output {
+			t.Errorf("%q printed %q, want %q", test.source, output, test.output)
+		}
+	}
+
+	// names given to marker as literals are known ahead of time
+	if output, err := runSource(t, `"scratch" marker "ok" print scratch`, Options{}); err != nil || output != "ok" {
+		t.Errorf("marker printed %q and failed with %v", output, err)
+	}
+}
+
+// TestLoadedSyntaxErrors checks that syntax errors in code run by
+// `runstring` or `runfile` point into that code, not at the call.
+func TestLoadedSyntaxErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bad.w")
+	if err := os.WriteFile(filename, []byte("1\n  }"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source string
+		file   string
+	}{
+		{`"1\n  }" runstring`, "<runstring "},
+		{strconv.Quote(filename) + " runfile", filename},
+	}
+	files := map[string]bool{}
+	for _, engine := range engines {
+		for _, test := range tests {
+			_, err := runSource(t, test.source, Options{engine: engine})
+			diag, _, ok := asDiagnostic(err)
+			if !ok || diag.code != CodeUnexpectedClose {
+				t.Errorf("%v: %q failed with %v, want %v", engine, test.source, err, CodeUnexpectedClose)
+				continue
+			}
+			if !strings.HasPrefix(diag.file, test.file) || diag.line != 1 || diag.col != 2 {
+				t.Errorf("%v: %q failed at %v:%v:%v, want %v...:1:2 (counting from 0)", engine, test.source, diag.file, diag.line, diag.col, test.file)
+			}
+			files[diag.file] = true
+		}
+	}
+	// every runstring gets its own name, so its source can be shown later
+	if len(files) != len(engines)+1 {
+		t.Errorf("errors were in %v, want a different file for each runstring", files)
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	tests := []struct {
+		source string
+		trace  []string
+	}{
+		{`"x" 1 +`, []string{}},
+		{`: f "x" + ; 1 f`, []string{"in `f`, called from test.w:1:15"}},
+		{": f \"x\" + ;\n: g 1 { f 0 } ;\ng", []string{
+			"in `f`, called from test.w:2:9",
+			"in `g`, called from test.w:3:1",
+		}},
+		{`: f "1 \"x\" +" runstring ; f`, []string{
+			"in code run by `runstring`, called from test.w:1:17",
+			"in `f`, called from test.w:1:29",
+		}},
+	}
+	for _, engine := range engines {
+		for _, test := range tests {
+			_, err := runSource(t, test.source, Options{engine: engine})
+			diag, _, ok := asDiagnostic(err)
+			if !ok {
+				t.Errorf("%v: %q failed with %v", engine, test.source, err)
+			} else if !slices.Equal(diag.trace, test.trace) {
+				t.Errorf("%v: %q has backtrace %q, want %q", engine, test.source, diag.trace, test.trace)
+			}
+		}
+	}
+}
+
+// TestBacktraceTruncated checks deep backtraces keep their ends and say how
+// many frames were left out of the middle.
+func TestBacktraceTruncated(t *testing.T) {
+	for _, engine := range engines {
+		_, err := runSource(t, `: f dup { 1 - f 0 } "x" + ; 30 f`, Options{engine: engine})
+		diag, _, ok := asDiagnostic(err)
+		if !ok {
+			t.Fatalf("%v: failed with %v", engine, err)
+		}
+		// 30 recursive calls and the first one
+		trace := diag.trace
+		if len(trace) != maxBacktrace+1 {
+			t.Fatalf("%v: backtrace has %v lines, want %v: %q", engine, len(trace), maxBacktrace+1, trace)
+		}
+		if trace[0] != "in `f`, called from test.w:1:15" || trace[maxBacktrace/2] != "... 11 more frames ..." || trace[maxBacktrace] != "in `f`, called from test.w:1:32" {
+			t.Errorf("%v: backtrace is %q", engine, trace)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// formatSource reprints a script with one tab of indentation for each open
+// definition or block, and single spaces between everything on a line. Line
+// breaks are kept where they were, except that runs of blank lines become one.
+// Scripts with syntax errors are left alone.
+func formatSource(file string, source []byte) (string, error) {
+	if parseState := parse(lex(file, bytes.NewReader(source), 0)); parseState.err != nil {
+		return "", parseState.err
+	}
+	lexer := lex(file, bytes.NewReader(source), 0)
+	lexer.trivia = true
+
+	var out strings.Builder
+	depth := 0
+	line := -1 // the source line the output has got up to
+	for {
+		lexeme, ok := lexer.next()
+		if !ok {
+			break
+		} else if lexeme.raw == "" {
+			continue
+		}
+		if line >= 0 && lexeme.line == line {
+			out.WriteByte(' ')
+		} else {
+			if line >= 0 {
+				out.WriteByte('\n')
+				if lexeme.line > line+1 {
+					out.WriteByte('\n')
+				}
+			}
+			indent := depth
+			if lexeme.kind == LexemeDefEnd || lexeme.kind == LexemeLoopEnd {
+				indent--
+			}
+			out.WriteString(strings.Repeat("\t", indent))
+		}
+		raw := lexeme.raw
+		if lexeme.kind == LexemeComment && lexeme.endLine == lexeme.line {
+			raw = strings.TrimRight(raw, " \t\r")
+		}
+		out.WriteString(raw)
+		switch lexeme.kind {
+		case LexemeDefBegin, LexemeLoopBegin:
+			depth++
+		case LexemeDefEnd, LexemeLoopEnd:
+			depth--
+		}
+		line = lexeme.endLine
+	}
+	if line >= 0 {
+		out.WriteByte('\n')
+	}
+	return out.String(), lexer.result()
+}
+
+// diffContext is how many unchanged lines are shown around each change.
+const diffContext = 3
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// diffLines returns the fewest edits turning one list of lines into another,
+// using Myers' algorithm in linear space, so big files don't need a table of
+// every pair of lines.
+func diffLines(before, after []string) []diffLine {
+	lines := []diffLine{}
+	diffRange(before, after, &lines)
+	return lines
+}
+
+func diffRange(before, after []string, out *[]diffLine) {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		*out = append(*out, diffLine{' ', before[prefix]})
+		prefix++
+	}
+	before, after = before[prefix:], after[prefix:]
+	suffix := 0
+	for suffix < len(before) && suffix < len(after) && before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	common := before[len(before)-suffix:]
+	before, after = before[:len(before)-suffix], after[:len(after)-suffix]
+
+	if x, y, ok := middleSnake(before, after); ok {
+		diffRange(before[:x], after[:y], out)
+		diffRange(before[x:], after[y:], out)
+	} else {
+		for _, line := range before {
+			*out = append(*out, diffLine{'-', line})
+		}
+		for _, line := range after {
+			*out = append(*out, diffLine{'+', line})
+		}
+	}
+	for _, line := range common {
+		*out = append(*out, diffLine{' ', line})
+	}
+}
+
+// middleSnake searches for the shortest edit path from both ends at once,
+// returning a point where the two searches meet, which splits the diff into
+// two smaller ones. It fails if the lists have nothing in common.
+func middleSnake(before, after []string) (int, int, bool) {
+	n, m := len(before), len(after)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// forward[offset+k] is the furthest x reached on diagonal k = x-y from
+	// the start, and backward the same counting back from the end
+	forward, backward := make([]int, 2*maxD+2), make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// with an odd delta the searches can only meet going forward, and with
+	// an even one going backward
+	front := delta%2 != 0
+	// diagonals that ran off the edges aren't searched any more
+	forwardStart, forwardEnd, backwardStart, backwardEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && before[x] == after[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			if x > n {
+				forwardEnd += 2
+			} else if y > m {
+				forwardStart += 2
+			} else if front {
+				if j := offset + delta - k; j >= 0 && j < len(backward) && backward[j] != -1 && x >= n-backward[j] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && before[n-x-1] == after[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			if x > n {
+				backwardEnd += 2
+			} else if y > m {
+				backwardStart += 2
+			} else if !front {
+				if j := offset + delta - k; j >= 0 && j < len(forward) && forward[j] != -1 && forward[j] >= n-x {
+					return forward[j], offset + forward[j] - j, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff describes the changes from before to after in unified diff
+// format, or returns "" if there are none.
+func unifiedDiff(file, before, after string) string {
+	lines := diffLines(splitLines(before), splitLines(after))
+	var out strings.Builder
+	// line numbers in before and after at the start of lines[i]
+	oldLine, newLine := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for i, line := range lines {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if line.op != '+' {
+			oldLine[i+1]++
+		}
+		if line.op != '-' {
+			newLine[i+1]++
+		}
+	}
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+		// a hunk runs until there are more than two contexts' worth of
+		// unchanged lines in a row
+		start := max(i-diffContext, 0)
+		end := i
+		for unchanged := 0; end < len(lines) && unchanged <= 2*diffContext; end++ {
+			if lines[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && lines[end-1].op == ' ' {
+			end--
+		}
+		end = min(end+diffContext, len(lines))
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %v\n+++ %v\n", file, file)
+		}
+		fmt.Fprintf(&out, "@@ -%v,%v +%v,%v @@\n",
+			oldLine[start]+1, oldLine[end]-oldLine[start], newLine[start]+1, newLine[end]-newLine[start])
+		for _, line := range lines[start:end] {
+			out.WriteByte(line.op)
+			out.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatSource(t *testing.T) {
+	tests := []struct {
+		source    string
+		formatted string
+	}{
+		{"1   2\t+", "1 2 +\n"},
+		{"  1\n", "1\n"},
+		{": f\n1 +\n;", ": f\n\t1 +\n;\n"},
+		{": f 1 { dup\n-- dup\n} ;", ": f 1 { dup\n\t\t-- dup\n\t} ;\n"},
+		{"1\n\n\n\n2\n", "1\n\n2\n"},
+		{"1 # note   \n2", "1 # note\n2\n"},
+		{"#( a\n  b )#   1", "#( a\n  b )# 1\n"},
+		{": f ( a -- b )   dup ;", ": f ( a -- b ) dup ;\n"},
+		// string literals are kept exactly as written
+		{`r"a\b"  "\t"   f"{}  {dup}"`, `r"a\b" "\t" f"{}  {dup}"` + "\n"},
+		{"\"\"\"\n  x\n  \"\"\"  print", "\"\"\"\n  x\n  \"\"\" print\n"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		formatted, err := formatSource("test.w", []byte(test.source))
+		if err != nil {
+			t.Errorf("%q failed: %v", test.source, err)
+		} else if formatted != test.formatted {
+			t.Errorf("%q formatted to %q, want %q", test.source, formatted, test.formatted)
+		}
+	}
+
+	if _, err := formatSource("test.w", []byte(": f 1")); errorCode(err) != CodeUnclosed {
+		t.Errorf("formatting a script with a syntax error failed with %v, want %v", err, CodeUnclosed)
+	}
+}
+
+// TestFormatIdempotent checks that formatting a formatted script leaves it
+// alone, and doesn't change what it does.
+func TestFormatIdempotent(t *testing.T) {
+	sources := []string{STDLIB}
+	scripts, err := filepath.Glob("../bench/*.w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range scripts {
+		source, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, string(source))
+	}
+	sources = append(sources, ": f\n  1 {\n dup   # c\n\n\n -- dup } drop ;\n\t\t3 f")
+	for _, source := range sources {
+		once, err := formatSource("test.w", []byte(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		twice, err := formatSource("test.w", []byte(once))
+		if err != nil {
+			t.Fatal(err)
+		} else if twice != once {
+			t.Errorf("formatting again changed\n%v\n%v", unifiedDiff("test.w", once, twice), source)
+		}
+		if formatTokens(parseSource(once, 0).root.children) != formatTokens(parseSource(source, 0).root.children) {
+			t.Errorf("formatting changed the meaning of\n%v", source)
+		}
+	}
+}
+
+// lcsLength is the length of the longest common subsequence of a and b,
+// worked out the slow way to check diffLines against.
+func lcsLength(a, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+	return lengths[0][0]
+}
+
+func TestDiffLines(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + random.Intn(4)))
+		}
+		return lines
+	}
+	for range 2000 {
+		before, after := randomLines(), randomLines()
+		lines := diffLines(before, after)
+		gotBefore, gotAfter, edits := []string{}, []string{}, 0
+		for _, line := range lines {
+			if line.op != '+' {
+				gotBefore = append(gotBefore, line.text)
+			}
+			if line.op != '-' {
+				gotAfter = append(gotAfter, line.text)
+			}
+			if line.op != ' ' {
+				edits++
+			}
+		}
+		if strings.Join(gotBefore, "") != strings.Join(before, "") || strings.Join(gotAfter, "") != strings.Join(after, "") {
+			t.Fatalf("diff of %q and %q doesn't give them back: %v", before, after, lines)
+		}
+		if want := len(before) + len(after) - 2*lcsLength(before, after); edits != want {
+			t.Fatalf("diff of %q and %q has %v edits, want %v", before, after, edits, want)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	before := make([]string, 20000)
+	for i := range before {
+		before[i] = strings.Repeat("x", i%7) + "\n"
+	}
+	after := append([]string{"new\n"}, before...)
+	after[10000] = "changed\n"
+	edits := 0
+	for _, line := range diffLines(before, after) {
+		if line.op != ' ' {
+			edits++
+		}
+	}
+	if edits != 3 {
+		t.Errorf("got %v edits, want 3", edits)
+	}
+}
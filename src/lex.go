@@ -1,5 +1,11 @@
 package main
 
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
 type LexemeKind int
 
 const (
@@ -10,6 +16,11 @@ const (
 	LexemeDefEnd
 	LexemeLoopBegin
 	LexemeLoopEnd
+	LexemeInterpBegin
+	LexemeInterpHole
+	LexemeInterpEnd
+	LexemeStackComment
+	LexemeComment // only kept in trivia mode
 )
 
 func (kind LexemeKind) String() string {
@@ -28,6 +39,16 @@ func (kind LexemeKind) String() string {
 		return "{"
 	case LexemeLoopEnd:
 		return "}"
+	case LexemeInterpBegin:
+		return "f\""
+	case LexemeInterpHole:
+		return "{}"
+	case LexemeInterpEnd:
+		return "\""
+	case LexemeStackComment:
+		return "stack-effect comment"
+	case LexemeComment:
+		return "comment"
 	}
 	return "unknown"
 }
@@ -39,46 +60,254 @@ type Lexeme struct {
 	file  string
 	line  int
 	col   int
+	// where the lexeme ends, just past its last rune. The first lexeme of an
+	// interpolated string covers the whole string.
+	endLine int
+	endCol  int
+	// in trivia mode, the source text of everything lexed along with this
+	// lexeme
+	raw string
 }
 
+// LexState reads a script from reader a chunk at a time. Only the bytes from
+// the start of the current token onwards are kept, so positions are offsets
+// into the whole script but can only be looked up while they are buffered.
 type LexState struct {
-	file        string
-	script      string
-	index       int
-	line        int
-	lastLineIdx int
-	err         error
-	lexemes     []Lexeme
+	*Diagnostics
+	file      string
+	reader    io.Reader
+	buf       []byte
+	base      int // offset of buf[0] in the script
+	eof       bool
+	index     int
+	line      int
+	lineStart int
+	start     lexPos // start of the token being lexed
+	startCol  int
+	// the column of colIndex, on the line starting at colLine
+	colLine  int
+	colIndex int
+	col      int
+	lexemes  []Lexeme // lexed but not yet handed to the parser
+	trivia   bool     // keep comments and the raw text of lexemes, for the formatter
+	cutOff   bool     // the script ended inside a comment or multiline string
 }
 
-func newLexState(file string, script string) LexState {
-	return LexState{
+const lexChunkSize = 64 * 1024
+
+func newLexState(file string, reader io.Reader, maxErrors int) *LexState {
+	return &LexState{
+		Diagnostics: &Diagnostics{maxErrors: maxErrors},
 		file:        file,
-		script:      script,
+		reader:      reader,
+		buf:         make([]byte, 0, lexChunkSize),
+		base:        0,
+		eof:         false,
 		index:       0,
 		line:        0,
-		lastLineIdx: 0,
-		err:         nil,
+		lineStart:   0,
 		lexemes:     make([]Lexeme, 0),
 	}
 }
 
+// fill reads another chunk of the script, first dropping whatever comes
+// before the current token.
+func (state *LexState) fill() {
+	if drop := state.start.index - state.base; drop > len(state.buf)/2 {
+		state.buf = state.buf[:copy(state.buf, state.buf[drop:])]
+		state.base += drop
+	}
+	if len(state.buf) == cap(state.buf) {
+		buf := make([]byte, len(state.buf), 2*cap(state.buf))
+		copy(buf, state.buf)
+		state.buf = buf
+	}
+	n, err := state.reader.Read(state.buf[len(state.buf):cap(state.buf)])
+	state.buf = state.buf[:len(state.buf)+n]
+	if err == io.EOF {
+		state.eof = true
+	} else if err != nil {
+		state.eof = true
+		state.report(fmt.Errorf("%s: %w", state.file, err))
+	}
+}
+
+// has reports whether the script is long enough to have a byte at index,
+// reading more of it if needed.
+func (state *LexState) has(index int) bool {
+	for index >= state.base+len(state.buf) {
+		if state.eof {
+			return false
+		}
+		state.fill()
+	}
+	return true
+}
+
+func (state *LexState) at(index int) byte {
+	return state.buf[index-state.base]
+}
+
+func (state *LexState) slice(from, to int) string {
+	return string(state.buf[from-state.base : to-state.base])
+}
+
+func (state *LexState) hasPrefix(index int, prefix string) bool {
+	if !state.has(index + len(prefix) - 1) {
+		return false
+	}
+	return string(state.buf[index-state.base:index-state.base+len(prefix)]) == prefix
+}
+
+func (state *LexState) decodeRune(index int) (rune, int) {
+	state.has(index + utf8.UTFMax - 1)
+	if !state.has(index) {
+		return utf8.RuneError, 0
+	}
+	return utf8.DecodeRune(state.buf[index-state.base:])
+}
+
+// lexPos is a position in the script, used to rewind the lexer so that errors
+// point at the start of a construct spanning several lines.
+type lexPos struct {
+	index     int
+	line      int
+	lineStart int
+}
+
+func (state *LexState) pos() lexPos {
+	return lexPos{state.index, state.line, state.lineStart}
+}
+
+func (state *LexState) seek(pos lexPos) {
+	state.index, state.line, state.lineStart = pos.index, pos.line, pos.lineStart
+}
+
 func (state *LexState) addLexeme(kind LexemeKind, text string, start int) *Lexeme {
+	return state.addLexemeAt(kind, text, lexPos{start, state.line, state.lineStart})
+}
+
+// column returns the zero-based column of pos, counted in runes so that it
+// lines up with what editors show. Columns are counted on from the last one
+// asked for, so asking in order only ever looks at each byte once.
+func (state *LexState) column(pos lexPos) int {
+	if pos.lineStart != state.colLine || pos.index < state.colIndex {
+		if pos.lineStart >= state.base {
+			state.colLine, state.colIndex, state.col = pos.lineStart, pos.lineStart, 0
+		} else {
+			// the start of a long line may be gone, but the token's start isn't
+			state.colLine, state.colIndex, state.col = state.start.lineStart, state.start.index, state.startCol
+		}
+	}
+	state.col += utf8.RuneCount(state.buf[state.colIndex-state.base : pos.index-state.base])
+	state.colIndex = pos.index
+	return state.col
+}
+
+func (state *LexState) runeAt(index int) rune {
+	c, _ := state.decodeRune(index)
+	return c
+}
+
+func (state *LexState) isWhitespaceAt(index int) bool {
+	return state.has(index) && isWhitespaceRune(state.runeAt(index))
+}
+
+func (state *LexState) skipWhitespace() {
+	for state.isWhitespaceAt(state.index) {
+		_, size := state.decodeRune(state.index)
+		state.index += size
+	}
+}
+
+func (state *LexState) isWordAt(index int) bool {
+	return state.has(index) && isWordRune(state.runeAt(index))
+}
+
+func (state *LexState) addLexemeAt(kind LexemeKind, text string, start lexPos) *Lexeme {
 	lexeme := Lexeme{
 		state: state,
 		kind:  kind,
 		text:  text,
 		file:  state.file,
-		line:  state.line,
-		col:   start - state.lastLineIdx,
+		line:  start.line,
+		col:   state.column(start),
 	}
+	lexeme.endLine, lexeme.endCol = state.line, state.column(state.pos())
 	state.lexemes = append(state.lexemes, lexeme)
 	return &lexeme
 }
 
+func (state *LexState) newline() {
+	state.index++
+	state.line++
+	state.lineStart = state.index
+}
+
+func (state *LexState) handleBlockComment() bool {
+	if !state.hasPrefix(state.index, "#(") {
+		return false
+	}
+	start := state.pos()
+	depth := 0
+	for state.has(state.index) {
+		if state.hasPrefix(state.index, "#(") {
+			depth++
+			state.index += 2
+		} else if state.hasPrefix(state.index, ")#") {
+			depth--
+			state.index += 2
+			if depth == 0 {
+				if state.trivia {
+					state.addLexemeAt(LexemeComment, "", start)
+				}
+				return true
+			}
+		} else if state.at(state.index) == '\n' {
+			state.newline()
+		} else {
+			state.index++
+		}
+	}
+	// point at the opening delimiter rather than the end of the file
+	return state.unterminated(start, "unterminated block comment")
+}
+
+// unterminated reports something that can span lines running into the end of
+// the script.
+func (state *LexState) unterminated(start lexPos, format string, args ...any) bool {
+	state.cutOff = true
+	return state.ErrorAt(start, CodeUnterminated, format, args...)
+}
+
+func (state *LexState) handleStackComment() bool {
+	if state.at(state.index) != '(' {
+		return false
+	}
+	// `(` only opens a comment when it stands alone, like in Forth
+	next := state.index + 1
+	if !state.atSeparator(next) {
+		return false
+	}
+	start := state.pos()
+	for state.has(state.index) {
+		c := state.at(state.index)
+		if c == ')' {
+			state.addLexemeAt(LexemeStackComment, state.slice(start.index+1, state.index), start)
+			state.index++
+			return true
+		} else if c == '\n' {
+			state.newline()
+		} else {
+			state.index++
+		}
+	}
+	return state.unterminated(start, "unterminated stack-effect comment")
+}
+
 func (state *LexState) handleSingleChar() bool {
 	lexeme := LexemeKind(-1)
-	c := state.script[state.index]
+	c := state.at(state.index)
 	switch c {
 	case ':':
 		lexeme = LexemeDefBegin
@@ -97,137 +326,190 @@ func (state *LexState) handleSingleChar() bool {
 	return false
 }
 
-func (state *LexState) handleString() bool {
-	c := state.script[state.index]
-	if c != '"' {
-		return false
-	}
-	start := state.index - 1
-	state.index++
-	text := ""
-	for state.index < len(state.script) {
-		c = state.script[state.index]
-		if c == '"' {
-			lexeme := state.addLexeme(LexemeString, text, start)
-			state.index++
-			if state.index < len(state.script) && !isWhitespace(state.script[state.index]) && state.script[state.index] != '\n' {
-				return lexeme.Error("expected whitespace after string")
+func (state *LexState) atSeparator(index int) bool {
+	return !state.has(index) || state.isWhitespaceAt(index) || state.at(index) == '\n'
+}
+
+// scanDigits consumes digits accepted by valid, allowing single `_`
+// separators between them, and returns how many digits were read.
+func (state *LexState) scanDigits(valid func(byte) bool) (count int, ok bool) {
+	for state.has(state.index) {
+		c := state.at(state.index)
+		if c == '_' {
+			next := state.index + 1
+			if count == 0 || !state.has(next) || !valid(state.at(next)) {
+				state.Error(CodeBadNumber, "misplaced digit separator")
+				return count, false
 			}
-			return true
-		} else if c == '\n' {
-			state.index = start
-			return state.Error("unexpected newline in string")
-		} else if c == '\\' {
 			state.index++
-			if state.index >= len(state.script) {
-				state.index = start
-				return state.Error("unexpected eof after escape character")
-			}
-			switch state.script[state.index] {
-			case 't':
-				c = '\t'
-			case 'r':
-				c = '\r'
-			case 'n':
-				c = '\n'
-			case '"':
-				c = '"'
-			case '\\':
-				c = '\\'
-			default:
-				state.index = start
-				return state.Error("invalid escape sequence `\\%v`", c)
-			}
+			continue
+		}
+		if !valid(c) {
+			break
 		}
-		text += string(c)
+		count++
 		state.index++
 	}
-	state.index = start
-	return state.Error("unexpected eof in string")
+	return count, true
 }
 
-func (state *LexState) handleNumber() bool {
-	c := state.script[state.index]
-	// make sure it starts with -, +, or a digit
-	if (c != '-' && c != '+') && !isDigit(c) {
+func (state *LexState) handleRadix(base string, valid func(byte) bool) bool {
+	prefix := state.index
+	state.index += 2 // move past the prefix
+	count, ok := state.scanDigits(valid)
+	if !ok {
 		return false
 	}
-	// if it is -/+, make sure the next char exists
-	if (c == '-' || c == '+') && state.index+1 >= len(state.script) {
+	if count == 0 {
+		state.index = prefix
+		state.Error(CodeBadNumber, "expected %v digits after `%v`", base, state.slice(prefix, prefix+2))
 		return false
 	}
-	start := state.index
-	if c == '-' || c == '+' {
-		// no need to bounds check here because of the one earlier
+	if state.isWordAt(state.index) {
+		state.Error(CodeBadNumber, "invalid digit `%c` in %v literal", state.runeAt(state.index), base)
+		return false
+	}
+	return true
+}
+
+func (state *LexState) handleDecimal() bool {
+	if _, ok := state.scanDigits(isDigit); !ok {
+		return false
+	}
+	if state.has(state.index) && state.at(state.index) == '.' {
+		dot := state.index
 		state.index++
-		c = state.script[state.index]
-		// since it is -/+, make sure the next char is digital
-		if !isDigit(c) {
-			// whoops, let's backpedal. this is a word.
-			state.index = start
+		count, ok := state.scanDigits(isDigit)
+		if !ok {
+			return false
+		}
+		if count == 0 {
+			state.index = dot
+			state.Error(CodeBadNumber, "expected digits after decimal point")
 			return false
 		}
 	}
-	for state.index < len(state.script) && isDigit(state.script[state.index]) {
-		state.index++
-	}
-	if state.index < len(state.script) && state.script[state.index] == '.' {
+	if state.has(state.index) && (state.at(state.index) == 'e' || state.at(state.index) == 'E') {
+		exponent := state.index
 		state.index++
-		hasSecondPart := false
-		for state.index < len(state.script) && isDigit(state.script[state.index]) {
+		if state.has(state.index) && (state.at(state.index) == '-' || state.at(state.index) == '+') {
 			state.index++
-			hasSecondPart = true
 		}
-		if !hasSecondPart {
-			num := state.script[start:state.index]
-			state.index = start
-			return state.Error("malformed number `%v`", num)
+		count, ok := state.scanDigits(isDigit)
+		if !ok {
+			return false
+		}
+		if count == 0 {
+			state.index = exponent
+			state.Error(CodeBadNumber, "expected digits in exponent")
+			return false
+		}
+	}
+	return true
+}
+
+func (state *LexState) handleNumber() bool {
+	start := state.index
+	digits := start
+	if c := state.at(digits); c == '-' || c == '+' {
+		digits++
+	}
+	for _, name := range []string{"inf", "nan"} {
+		if state.hasPrefix(digits, name) && state.atSeparator(digits+len(name)) {
+			state.index = digits + len(name)
+			state.addLexeme(LexemeNumber, state.slice(start, state.index), start)
+			return true
+		}
+	}
+	// make sure it starts with a digit, or a dot followed by one
+	if !state.has(digits) || !(isDigit(state.at(digits)) || (state.at(digits) == '.' && state.has(digits+1) && isDigit(state.at(digits+1)))) {
+		return false
+	}
+	state.index = digits
+	ok := true
+	if state.at(digits) == '0' && state.has(digits+1) {
+		switch state.at(digits + 1) {
+		case 'x', 'X':
+			ok = state.handleRadix("hexadecimal", isHexDigit)
+		case 'b', 'B':
+			ok = state.handleRadix("binary", isBinaryDigit)
+		case 'o', 'O':
+			ok = state.handleRadix("octal", isOctalDigit)
+		default:
+			ok = state.handleDecimal()
 		}
+	} else {
+		ok = state.handleDecimal()
 	}
-	if !isWhitespace(state.script[state.index]) && state.script[state.index] != '\n' {
-		c := state.script[state.index]
-		state.index = start - 1
-		return state.Error("expected whitespace after number, got `%v`", c)
+	if !ok {
+		return true
 	}
-	state.addLexeme(LexemeNumber, state.script[start:state.index], start)
+	if !state.atSeparator(state.index) {
+		return state.Error(CodeMissingSpace, "expected whitespace after number, got `%c`", state.runeAt(state.index))
+	}
+	state.addLexeme(LexemeNumber, state.slice(start, state.index), start)
 	return true
 }
 
 func (state *LexState) handleWord() bool {
-	c := state.script[state.index]
-	if !isWordChar(c) {
+	if !state.isWordAt(state.index) {
 		return false
 	}
 	start := state.index
-	state.index++
-	for state.index < len(state.script) && isWordChar(state.script[state.index]) {
-		state.index++
+	for state.isWordAt(state.index) {
+		_, size := state.decodeRune(state.index)
+		state.index += size
 	}
-	state.addLexeme(LexemeWord, state.script[start:state.index], start)
+	state.addLexeme(LexemeWord, state.slice(start, state.index), start)
 	return true
 }
 
 func (state *LexState) step() {
-	if state.index >= len(state.script) {
+	if !state.has(state.index) {
+		return
+	}
+	state.start = state.pos()
+	state.startCol = state.column(state.start)
+	before := len(state.lexemes)
+	state.dispatch()
+	if len(state.lexemes) > before {
+		// lexemes after the first, like the parts of an interpolated string,
+		// are covered by it
+		first := &state.lexemes[before]
+		first.endLine, first.endCol = state.line, state.column(state.pos())
+		if state.trivia {
+			first.raw = state.slice(state.start.index, state.index)
+		}
+	}
+}
+
+func (state *LexState) dispatch() {
+	c, size := state.decodeRune(state.index)
+	if c == utf8.RuneError && size == 1 {
+		state.Error(CodeBadCharacter, "invalid UTF-8 byte `\\x%02X`", state.at(state.index))
 		return
 	}
-	c := state.script[state.index]
 	if c == '\n' { // Handle newline
-		state.lastLineIdx = state.index
-		state.line++
-		state.index++
+		state.newline()
 		return
 	}
-	if c == '#' { // Handle/skip comments
-		for state.index < len(state.script) && state.script[state.index] != '\n' {
-			state.index++
-		}
+	if state.handleBlockComment() {
 		return
 	}
-	if isWhitespace(c) { // Handle whitespace
-		for state.index < len(state.script) && isWhitespace(state.script[state.index]) {
+	if c == '#' { // Handle/skip comments, which also covers a `#!` line at the top
+		for state.has(state.index) && state.at(state.index) != '\n' {
 			state.index++
 		}
+		if state.trivia {
+			state.addLexemeAt(LexemeComment, "", state.start)
+		}
+		return
+	}
+	if isWhitespaceRune(c) { // Handle whitespace
+		state.skipWhitespace()
+		return
+	}
+	if state.handleStackComment() {
 		return
 	}
 	if state.handleSingleChar() {
@@ -242,13 +524,40 @@ func (state *LexState) step() {
 	if state.handleWord() {
 		return
 	}
-	state.Error("unexpected character `%v`", c)
+	state.Error(CodeBadCharacter, "unexpected character `%c`", c)
 }
 
-func lex(file, script string) (state LexState) {
-	state = newLexState(file, script)
-	for state.index < len(state.script) && state.err == nil {
+// recover skips the rest of a malformed token so lexing can carry on after it.
+func (state *LexState) recover() {
+	for state.has(state.index) && !state.atSeparator(state.index) {
+		_, size := state.decodeRune(state.index)
+		state.index += size
+	}
+}
+
+// next returns the next lexeme, reading and lexing more of the script as
+// needed. It returns false once the script or the error budget runs out.
+func (state *LexState) next() (Lexeme, bool) {
+	for len(state.lexemes) == 0 {
+		if state.full() || !state.has(state.index) {
+			return Lexeme{}, false
+		}
+		errs := len(state.errs)
 		state.step()
+		if len(state.errs) > errs {
+			state.recover()
+		}
+	}
+	lexeme := state.lexemes[0]
+	state.lexemes = state.lexemes[1:]
+	if len(state.lexemes) == 0 {
+		state.lexemes = state.lexemes[:0]
 	}
-	return
+	return lexeme, true
+}
+
+// lex starts lexing a script from reader. Lexemes are produced as the parser
+// asks for them, so the script never has to be in memory all at once.
+func lex(file string, reader io.Reader, maxErrors int) *LexState {
+	return newLexState(file, reader, maxErrors)
 }
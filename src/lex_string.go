@@ -0,0 +1,455 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// handleEscape decodes the escape sequence whose backslash is at state.index
+// and writes the result to text.
+func (state *LexState) handleEscape(text *strings.Builder) bool {
+	escape := state.index
+	state.index++
+	if !state.has(state.index) {
+		state.index = escape
+		state.Error(CodeBadEscape, "unexpected eof after escape character")
+		return false
+	}
+	c, size := state.decodeRune(state.index)
+	state.index += size
+	switch c {
+	case 't':
+		text.WriteByte('\t')
+	case 'r':
+		text.WriteByte('\r')
+	case 'n':
+		text.WriteByte('\n')
+	case '0':
+		text.WriteByte(0)
+	case 'e':
+		text.WriteByte(0x1b)
+	case '"':
+		text.WriteByte('"')
+	case '\\':
+		text.WriteByte('\\')
+	case 'x':
+		end := state.index
+		for end < state.index+2 && state.has(end) {
+			end++
+		}
+		digits := state.slice(state.index, end)
+		value, err := strconv.ParseUint(digits, 16, 8)
+		if err != nil || len(digits) != 2 {
+			state.index = escape
+			state.Error(CodeBadEscape, "invalid escape sequence `\\x%v`, expected two hex digits", digits)
+			return false
+		}
+		text.WriteByte(byte(value))
+		state.index = end
+	case 'u':
+		if !state.has(state.index) || state.at(state.index) != '{' {
+			state.index = escape
+			state.Error(CodeBadEscape, "invalid escape sequence `\\u`, expected `{` after it")
+			return false
+		}
+		end := state.index + 1
+		for state.has(end) && isHexDigit(state.at(end)) {
+			end++
+		}
+		if !state.has(end) || state.at(end) != '}' {
+			state.index = escape
+			state.Error(CodeBadEscape, "malformed unicode escape sequence, expected hex digits followed by `}`")
+			return false
+		}
+		digits := state.slice(state.index+1, end)
+		value, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil || len(digits) > 6 {
+			state.index = escape
+			state.Error(CodeBadEscape, "invalid unicode escape sequence `\\u{%v}`", digits)
+			return false
+		}
+		if !utf8.ValidRune(rune(value)) {
+			state.index = escape
+			state.Error(CodeBadEscape, "invalid code point `U+%04X` in unicode escape sequence", value)
+			return false
+		}
+		text.WriteRune(rune(value))
+		state.index = end + 1
+	default:
+		state.index = escape
+		if unicode.IsPrint(c) {
+			state.Error(CodeBadEscape, "invalid escape sequence `\\%c`", c)
+		} else {
+			state.Error(CodeBadEscape, "invalid escape sequence, `\\` followed by %U", c)
+		}
+		return false
+	}
+	return true
+}
+
+func (state *LexState) handleString() bool {
+	switch {
+	case state.hasPrefix(state.index, `r"""`):
+		return state.handleTripleString(true)
+	case state.hasPrefix(state.index, `"""`):
+		return state.handleTripleString(false)
+	case state.hasPrefix(state.index, `r"`):
+		return state.handleQuotedString(true)
+	case state.hasPrefix(state.index, `f"`):
+		return state.handleInterpString()
+	case state.hasPrefix(state.index, `"`):
+		return state.handleQuotedString(false)
+	case state.hasPrefix(state.index, "<<"):
+		return state.handleHeredoc()
+	}
+	return false
+}
+
+func (state *LexState) handleQuotedString(raw bool) bool {
+	start := state.index
+	if raw {
+		state.index++ // move past 'r'
+	}
+	state.index++
+	var text strings.Builder
+	for state.has(state.index) {
+		c := state.at(state.index)
+		if c == '"' {
+			if !utf8.ValidString(text.String()) {
+				state.index++
+				return state.ErrorAt(lexPos{start, state.line, state.lineStart}, CodeBadCharacter, "string is not valid UTF-8")
+			}
+			lexeme := state.addLexeme(LexemeString, text.String(), start)
+			state.index++
+			if !state.atSeparator(state.index) {
+				return lexeme.Error(CodeMissingSpace, "expected whitespace after string")
+			}
+			return true
+		} else if c == '\n' {
+			return state.ErrorAt(lexPos{start, state.line, state.lineStart}, CodeUnterminated, "unexpected newline in string")
+		} else if c == '\\' && !raw {
+			if !state.handleEscape(&text) {
+				state.skipString()
+				return true
+			}
+			continue
+		}
+		text.WriteByte(c)
+		state.index++
+	}
+	return state.ErrorAt(lexPos{start, state.line, state.lineStart}, CodeUnterminated, "unexpected eof in string")
+}
+
+// skipString moves past the rest of a malformed single-line string, so lexing
+// can carry on after it.
+func (state *LexState) skipString() {
+	for state.has(state.index) && state.at(state.index) != '\n' {
+		c := state.at(state.index)
+		state.index++
+		if c == '"' {
+			return
+		} else if c == '\\' && state.has(state.index) && state.at(state.index) != '\n' {
+			state.index++
+		}
+	}
+}
+
+// handleInterpString splits an interpolated string into its literal parts and
+// the `{word}` or `{}` segments between them, which the parser turns into
+// tokens that build the final string.
+func (state *LexState) handleInterpString() bool {
+	start := state.index
+	begin := len(state.lexemes)
+	state.addLexeme(LexemeInterpBegin, "", start)
+	// drop the parts lexed so far, so the parser never sees half a string
+	fail := func() bool {
+		state.lexemes = state.lexemes[:begin]
+		state.skipString()
+		return true
+	}
+	state.index += 2 // move past `f"`
+	holes := 0
+	var text strings.Builder
+	part := state.index
+	flush := func() bool {
+		if text.Len() == 0 {
+			return true
+		}
+		if !utf8.ValidString(text.String()) {
+			state.ErrorAt(lexPos{part, state.line, state.lineStart}, CodeBadCharacter, "string is not valid UTF-8")
+			return false
+		}
+		state.addLexeme(LexemeString, text.String(), part)
+		text.Reset()
+		return true
+	}
+	for state.has(state.index) {
+		c := state.at(state.index)
+		switch {
+		case c == '"':
+			if !flush() {
+				return fail()
+			}
+			state.lexemes[begin].text = strconv.Itoa(holes)
+			lexeme := state.addLexeme(LexemeInterpEnd, "", state.index)
+			state.index++
+			if !state.atSeparator(state.index) {
+				return lexeme.Error(CodeMissingSpace, "expected whitespace after string")
+			}
+			return true
+		case c == '\n':
+			state.lexemes = state.lexemes[:begin]
+			return state.ErrorAt(lexPos{start, state.line, state.lineStart}, CodeUnterminated, "unexpected newline in string")
+		case c == '\\':
+			if !state.handleEscape(&text) {
+				return fail()
+			}
+		case state.hasPrefix(state.index, "{{"), state.hasPrefix(state.index, "}}"):
+			text.WriteByte(c)
+			state.index += 2
+		case c == '}':
+			state.Error(CodeBadString, "unmatched `}` in interpolated string, use `}}` for a literal brace")
+			return fail()
+		case c == '{':
+			if !flush() || !state.handleInterpSegment(&holes) {
+				return fail()
+			}
+			part = state.index
+		default:
+			text.WriteByte(c)
+			state.index++
+		}
+	}
+	state.lexemes = state.lexemes[:begin]
+	return state.ErrorAt(lexPos{start, state.line, state.lineStart}, CodeUnterminated, "unexpected eof in string")
+}
+
+// handleInterpSegment lexes a `{...}` segment of an interpolated string,
+// which is either empty or holds a single word.
+func (state *LexState) handleInterpSegment(holes *int) bool {
+	open := state.index
+	state.index++
+	state.skipWhitespace()
+	word := state.index
+	for state.isWordAt(state.index) && state.at(state.index) != '}' {
+		_, size := state.decodeRune(state.index)
+		state.index += size
+	}
+	end := state.index
+	state.skipWhitespace()
+	if !state.has(state.index) || state.at(state.index) == '"' || state.at(state.index) == '\n' {
+		state.index = open
+		state.Error(CodeBadString, "unterminated `{` in interpolated string")
+		return false
+	}
+	if state.at(state.index) != '}' {
+		state.Error(CodeBadString, "expected `}` after word in interpolated string, got `%c`", state.runeAt(state.index))
+		return false
+	}
+	if word == end {
+		state.addLexeme(LexemeInterpHole, "", open)
+		*holes++
+	} else {
+		state.addLexeme(LexemeWord, state.slice(word, end), word)
+	}
+	state.index++
+	return true
+}
+
+func (state *LexState) handleTripleString(raw bool) bool {
+	start := state.pos()
+	if raw {
+		state.index++ // move past 'r'
+	}
+	state.index += 3
+	body := state.pos()
+	for state.has(state.index) {
+		c := state.at(state.index)
+		if state.hasPrefix(state.index, `"""`) {
+			lines, trailingNewline := state.dedentLines(body, state.index)
+			closing := state.pos()
+			text, ok := state.joinLines(lines, trailingNewline, raw)
+			if !ok {
+				state.seek(closing)
+				state.index += 3
+				return true
+			}
+			state.index += 3
+			if !utf8.ValidString(text) {
+				return state.ErrorAt(start, CodeBadCharacter, "string is not valid UTF-8")
+			}
+			lexeme := state.addLexemeAt(LexemeString, text, start)
+			if !state.atSeparator(state.index) {
+				return lexeme.Error(CodeMissingSpace, "expected whitespace after string")
+			}
+			return true
+		} else if c == '\n' {
+			state.newline()
+		} else if c == '\\' && !raw && state.has(state.index+1) && state.at(state.index+1) != '\n' {
+			state.index += 2 // escapes are decoded once the whole string is known
+		} else {
+			state.index++
+		}
+	}
+	return state.unterminated(start, "unterminated multiline string")
+}
+
+func isTagChar(char byte, first bool) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (!first && isDigit(char))
+}
+
+func (state *LexState) handleHeredoc() bool {
+	start := state.pos()
+	tagStart := state.index + 2
+	tagEnd := tagStart
+	for state.has(tagEnd) && isTagChar(state.at(tagEnd), tagEnd == tagStart) {
+		tagEnd++
+	}
+	if tagEnd == tagStart || state.isWordAt(tagEnd) {
+		return false // just a word starting with `<<`
+	}
+	tag := state.slice(tagStart, tagEnd)
+	state.index = tagEnd
+	body := state.pos()
+	for state.has(state.index) && isWhitespace(state.at(state.index)) {
+		state.index++
+	}
+	if state.has(state.index) && state.at(state.index) != '\n' {
+		return state.Error(CodeBadString, "expected newline after heredoc tag `%v`", tag)
+	}
+	for state.has(state.index) {
+		state.newline()
+		indent := state.index
+		for state.has(indent) && isWhitespace(state.at(indent)) {
+			indent++
+		}
+		if state.hasPrefix(indent, tag) && state.atSeparator(indent+len(tag)) {
+			lines, trailingNewline := state.dedentLines(body, indent)
+			text, _ := state.joinLines(lines, trailingNewline, true)
+			state.addLexemeAt(LexemeString, text, start)
+			state.index = indent + len(tag)
+			return true
+		}
+		for state.has(state.index) && state.at(state.index) != '\n' {
+			state.index++
+		}
+	}
+	return state.unterminated(start, "unterminated heredoc, expected `%v`", tag)
+}
+
+// textLine is a single line of a multiline string literal, with its
+// indentation already stripped.
+type textLine struct {
+	start lexPos
+	end   int
+}
+
+func isBlank(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if !isWhitespace(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func leadingWhitespace(text string) string {
+	i := 0
+	for i < len(text) && isWhitespace(text[i]) {
+		i++
+	}
+	return text[:i]
+}
+
+// dedentLines splits the script between from and end into lines and strips
+// the indentation they have in common. A blank first line is dropped, and so
+// is a blank last line, which still counts towards the indentation since it
+// holds the closing delimiter.
+func (state *LexState) dedentLines(from lexPos, end int) (lines []textLine, trailingNewline bool) {
+	pos := from
+	for {
+		lineEnd := strings.IndexByte(state.slice(pos.index, end), '\n')
+		if lineEnd < 0 {
+			lines = append(lines, textLine{pos, end})
+			break
+		}
+		lineEnd += pos.index
+		lines = append(lines, textLine{pos, lineEnd})
+		pos = lexPos{lineEnd + 1, pos.line + 1, lineEnd + 1}
+	}
+	if len(lines) == 1 {
+		return
+	}
+	text := func(line textLine) string {
+		return state.slice(line.start.index, line.end)
+	}
+	if isBlank(text(lines[0])) {
+		lines = lines[1:]
+	}
+	var indent *string
+	last := lines[len(lines)-1]
+	if isBlank(text(last)) {
+		trailingNewline = true
+		lines = lines[:len(lines)-1]
+		lastIndent := text(last)
+		indent = &lastIndent
+	}
+	for _, line := range lines {
+		if isBlank(text(line)) {
+			continue
+		}
+		lineIndent := leadingWhitespace(text(line))
+		if indent == nil {
+			indent = &lineIndent
+			continue
+		}
+		common := 0
+		for common < len(*indent) && common < len(lineIndent) && (*indent)[common] == lineIndent[common] {
+			common++
+		}
+		shared := (*indent)[:common]
+		indent = &shared
+	}
+	for i, line := range lines {
+		if isBlank(text(line)) {
+			lines[i].start.index = line.end
+		} else if indent != nil {
+			lines[i].start.index += len(*indent)
+		}
+	}
+	return
+}
+
+// joinLines builds the text of a multiline string, decoding escapes unless it
+// is raw. Escapes are decoded in place so errors point at the right line.
+func (state *LexState) joinLines(lines []textLine, trailingNewline bool, raw bool) (string, bool) {
+	end := state.pos()
+	var text strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			text.WriteByte('\n')
+		}
+		if raw {
+			text.WriteString(state.slice(line.start.index, line.end))
+			continue
+		}
+		state.seek(line.start)
+		for state.index < line.end {
+			if state.at(state.index) == '\\' {
+				if !state.handleEscape(&text) {
+					return "", false
+				}
+				continue
+			}
+			text.WriteByte(state.at(state.index))
+			state.index++
+		}
+	}
+	if trailingNewline && len(lines) > 0 {
+		text.WriteByte('\n')
+	}
+	state.seek(end)
+	return text.String(), true
+}
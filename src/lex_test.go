@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// lexAll lexes source a byte at a time, so every token straddles a read.
+func lexAll(source string) ([]Lexeme, error) {
+	lexer := lex("test.w", iotest.OneByteReader(strings.NewReader(source)), 0)
+	lexemes := []Lexeme{}
+	for {
+		lexeme, ok := lexer.next()
+		if !ok {
+			break
+		}
+		lexemes = append(lexemes, lexeme)
+	}
+	return lexemes, lexer.result()
+}
+
+func TestLexStrings(t *testing.T) {
+	tests := []struct {
+		source string
+		text   string
+	}{
+		{`"plain"`, "plain"},
+		{`"\t\r\n"`, "\t\r\n"},
+		{`"\"\\"`, `"\`},
+		{`"\0\e"`, "\x00\x1b"},
+		{`"\x41\x7e"`, "A~"},
+		{`"\u{41}\u{e9}\u{1F600}"`, "Aé😀"},
+		{`"π → ∞"`, "π → ∞"},
+		{`r"C:\new\folder"`, `C:\new\folder`},
+		{"\"\"\"\n\tHello,\n\t  world!\n\t\"\"\"", "Hello,\n  world!\n"},
+		{"r\"\"\"\n\t\\n\n\t\"\"\"", "\\n\n"},
+		{"<<END\n\t\"quotes\" and \\backslashes\\\n\tEND", "\"quotes\" and \\backslashes\\\n"},
+	}
+	for _, test := range tests {
+		lexemes, err := lexAll(test.source)
+		if err != nil {
+			t.Errorf("%q failed: %v", test.source, err)
+		} else if len(lexemes) != 1 || lexemes[0].kind != LexemeString {
+			t.Errorf("%q lexed to %v, want one string", test.source, lexemes)
+		} else if lexemes[0].text != test.text {
+			t.Errorf("%q lexed to %q, want %q", test.source, lexemes[0].text, test.text)
+		}
+	}
+}
+
+func TestLexComments(t *testing.T) {
+	tests := []struct {
+		source string
+		words  []string
+	}{
+		{"a # b\nc", []string{"a", "c"}},
+		{"a #( b )# c", []string{"a", "c"}},
+		{"a #( b\n#( c )#\nd )# e", []string{"a", "e"}},
+		{"#!/usr/bin/env wafer\na", []string{"a"}},
+		{"a#b", []string{"a#b"}},
+	}
+	for _, test := range tests {
+		lexemes, err := lexAll(test.source)
+		words := []string{}
+		for _, lexeme := range lexemes {
+			words = append(words, lexeme.text)
+		}
+		if err != nil {
+			t.Errorf("%q failed: %v", test.source, err)
+		} else if strings.Join(words, " ") != strings.Join(test.words, " ") {
+			t.Errorf("%q lexed to %q, want %q", test.source, words, test.words)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		codes  []ErrorCode
+	}{
+		{`"open`, []ErrorCode{CodeUnterminated}},
+		{"#( open", []ErrorCode{CodeUnterminated}},
+		{`"""` + "\nopen", []ErrorCode{CodeUnterminated}},
+		{`"\q"`, []ErrorCode{CodeBadEscape}},
+		{`"\x4"`, []ErrorCode{CodeBadEscape}},
+		{`"\u{110000}"`, []ErrorCode{CodeBadEscape}},
+		{`"\xff"`, []ErrorCode{CodeBadCharacter}},
+		{"0x", []ErrorCode{CodeBadNumber}},
+		{"0b102", []ErrorCode{CodeBadNumber}},
+		{"1__0", []ErrorCode{CodeBadNumber}},
+		{"1.", []ErrorCode{CodeBadNumber}},
+		{"1e", []ErrorCode{CodeBadNumber}},
+		{`1"x"`, []ErrorCode{CodeMissingSpace}},
+		// lexing carries on after each error
+		{`"\q" 0x "ok" 1e`, []ErrorCode{CodeBadEscape, CodeBadNumber, CodeBadNumber}},
+	}
+	for _, test := range tests {
+		_, err := lexAll(test.source)
+		codes := []ErrorCode{}
+		for _, err := range unwrapErrors(err) {
+			codes = append(codes, errorCode(err))
+		}
+		if strings.Join(codeStrings(codes), " ") != strings.Join(codeStrings(test.codes), " ") {
+			t.Errorf("%q failed with %v (%v), want %v", test.source, codes, err, test.codes)
+		}
+	}
+}
+
+// TestLexPositions checks where lexemes start and end, counting lines and
+// columns in runes from zero.
+func TestLexPositions(t *testing.T) {
+	lexemes, err := lexAll("π 12\n  \"\"\"\na\n\"\"\" f\"{x}\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][4]int{{0, 0, 0, 1}, {0, 2, 0, 4}, {1, 2, 3, 3}, {3, 4, 3, 10}}
+	for i, pos := range want {
+		lexeme := lexemes[i]
+		if got := [4]int{lexeme.line, lexeme.col, lexeme.endLine, lexeme.endCol}; got != pos {
+			t.Errorf("%q is at %v, want %v", lexeme.text, got, pos)
+		}
+	}
+}
+
+// unwrapErrors splits errors joined by Diagnostics.result.
+func unwrapErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	} else if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func codeStrings(codes []ErrorCode) []string {
+	strs := []string{}
+	for _, code := range codes {
+		strs = append(strs, string(code))
+	}
+	return strs
+}
+
+// TestLexLargeSource lexes a script several chunks long, with a string bigger
+// than a chunk, to check nothing is lost when the buffer is refilled.
+func TestLexLargeSource(t *testing.T) {
+	long := strings.Repeat("x", 3*lexChunkSize/2)
+	var source strings.Builder
+	for i := 0; i < 20000; i++ {
+		source.WriteString("word 12 \"str\"\n")
+	}
+	source.WriteString(`"` + long + `" end`)
+	lexer := lex("test.w", strings.NewReader(source.String()), 0)
+	count := 0
+	var last []Lexeme
+	for {
+		lexeme, ok := lexer.next()
+		if !ok {
+			break
+		}
+		count++
+		if last = append(last, lexeme); len(last) > 2 {
+			last = last[1:]
+		}
+	}
+	if err := lexer.result(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3*20000+2 {
+		t.Errorf("lexed %v lexemes, want %v", count, 3*20000+2)
+	}
+	if last[0].text != long || last[0].line != 20000 || last[1].text != "end" {
+		t.Errorf("lexed the end as %q at line %v then %q", last[0].text[:10], last[0].line, last[1].text)
+	}
+}
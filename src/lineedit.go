@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C is pressed.
+var errInterrupted = errors.New("interrupted")
+
+// maxHistory is how many lines of history are kept.
+const maxHistory = 1000
+
+// LineEditor reads lines of input. On a terminal that supports it, lines can
+// be edited with the usual keys, earlier lines recalled with the arrow keys,
+// and words completed with tab.
+type LineEditor struct {
+	in          *os.File
+	out         *os.File
+	reader      *bufio.Reader
+	terminal    bool
+	history     []string
+	historyPath string
+	// complete lists what could finish word, which is typed after before.
+	// Only candidates starting with word are offered.
+	complete func(before, word string) []string
+}
+
+func newLineEditor(in, out *os.File) *LineEditor {
+	info, err := in.Stat()
+	return &LineEditor{
+		in:       in,
+		out:      out,
+		reader:   bufio.NewReader(in),
+		terminal: err == nil && info.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// historyFile is where history is kept between sessions.
+func historyFile() (string, bool) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(home, ".wafer_history"), true
+}
+
+// loadHistory reads earlier history from path, which new lines are then added
+// to. A missing file just means there's no history yet.
+func (editor *LineEditor) loadHistory(path string) {
+	editor.historyPath = path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+		os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	}
+	editor.history = slices.DeleteFunc(lines, func(line string) bool { return line == "" })
+}
+
+// addHistory remembers a line, saving it straight away so it isn't lost if
+// the session ends badly. Blank lines and repeats are skipped.
+func (editor *LineEditor) addHistory(line string) {
+	line = strings.TrimRightFunc(line, unicode.IsSpace)
+	if line == "" || strings.Contains(line, "\n") {
+		return
+	} else if len(editor.history) > 0 && editor.history[len(editor.history)-1] == line {
+		return
+	}
+	editor.history = append(editor.history, line)
+	if len(editor.history) > maxHistory {
+		editor.history = editor.history[1:]
+	}
+	if editor.historyPath == "" {
+		return
+	}
+	file, err := os.OpenFile(editor.historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(file, line)
+	file.Close()
+}
+
+// readLine reads a line, without its line break. It returns io.EOF at the end
+// of the input and errInterrupted when Ctrl-C is pressed.
+func (editor *LineEditor) readLine(prompt string) (string, error) {
+	if !editor.terminal {
+		return editor.readPlain("")
+	}
+	restore, err := rawMode(int(editor.in.Fd()))
+	if err != nil {
+		return editor.readPlain(prompt)
+	}
+	defer restore()
+	edit := &editLine{editor: editor, prompt: prompt, index: len(editor.history)}
+	return edit.run()
+}
+
+func (editor *LineEditor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(editor.out, prompt)
+	line, err := editor.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// editLine is a line being edited in raw mode.
+type editLine struct {
+	editor *LineEditor
+	prompt string
+	line   []rune
+	cursor int
+	index  int    // the history entry being shown, or len(history) for the new line
+	draft  []rune // the new line, kept while looking through history
+}
+
+func (edit *editLine) run() (string, error) {
+	edit.refresh()
+	for {
+		char, _, err := edit.editor.reader.ReadRune()
+		if err != nil {
+			fmt.Fprint(edit.editor.out, "\n")
+			return "", err
+		}
+		switch char {
+		case '\r', '\n':
+			edit.cursor = len(edit.line)
+			edit.refresh()
+			fmt.Fprint(edit.editor.out, "\n")
+			return string(edit.line), nil
+		case ctrl('C'):
+			fmt.Fprint(edit.editor.out, "^C\n")
+			return "", errInterrupted
+		case ctrl('D'):
+			if len(edit.line) == 0 {
+				fmt.Fprint(edit.editor.out, "\n")
+				return "", io.EOF
+			}
+			edit.delete(edit.cursor, edit.cursor+1)
+		case ctrl('A'):
+			edit.moveTo(0)
+		case ctrl('E'):
+			edit.moveTo(len(edit.line))
+		case ctrl('B'):
+			edit.moveTo(edit.cursor - 1)
+		case ctrl('F'):
+			edit.moveTo(edit.cursor + 1)
+		case ctrl('H'), 0x7f:
+			edit.delete(edit.cursor-1, edit.cursor)
+		case ctrl('K'):
+			edit.delete(edit.cursor, len(edit.line))
+		case ctrl('U'):
+			edit.delete(0, edit.cursor)
+		case ctrl('W'):
+			edit.delete(edit.wordStart(), edit.cursor)
+		case ctrl('L'):
+			fmt.Fprint(edit.editor.out, "\x1b[H\x1b[2J")
+			edit.refresh()
+		case ctrl('P'):
+			edit.recall(edit.index - 1)
+		case ctrl('N'):
+			edit.recall(edit.index + 1)
+		case '\t':
+			edit.complete()
+		case 0x1b:
+			edit.escape()
+		default:
+			if unicode.IsPrint(char) {
+				edit.insert([]rune{char})
+			}
+		}
+	}
+}
+
+func ctrl(char byte) rune {
+	return rune(char & 0x1f)
+}
+
+// escape handles the escape sequences sent by arrow keys and the like.
+func (edit *editLine) escape() {
+	reader := edit.editor.reader
+	kind, _, err := reader.ReadRune()
+	if err != nil || (kind != '[' && kind != 'O') {
+		return
+	}
+	key, _, err := reader.ReadRune()
+	if err != nil {
+		return
+	}
+	if key >= '0' && key <= '9' {
+		// like `ESC [ 3 ~`, possibly with modifiers as in `ESC [ 1 ; 5 C`
+		number := key
+		for key != '~' && !unicode.IsLetter(key) {
+			if key, _, err = reader.ReadRune(); err != nil {
+				return
+			}
+		}
+		if key == '~' {
+			key = number
+		}
+	}
+	switch key {
+	case 'A':
+		edit.recall(edit.index - 1)
+	case 'B':
+		edit.recall(edit.index + 1)
+	case 'C':
+		edit.moveTo(edit.cursor + 1)
+	case 'D':
+		edit.moveTo(edit.cursor - 1)
+	case 'H', '1', '7':
+		edit.moveTo(0)
+	case 'F', '4', '8':
+		edit.moveTo(len(edit.line))
+	case '3':
+		edit.delete(edit.cursor, edit.cursor+1)
+	}
+}
+
+// refresh redraws the line, assuming it fits on one row of the terminal.
+func (edit *editLine) refresh() {
+	out := edit.editor.out
+	fmt.Fprintf(out, "\r%s%s\x1b[K", edit.prompt, string(edit.line))
+	if back := len(edit.line) - edit.cursor; back > 0 {
+		fmt.Fprintf(out, "\x1b[%dD", back)
+	}
+}
+
+func (edit *editLine) moveTo(cursor int) {
+	edit.cursor = max(0, min(cursor, len(edit.line)))
+	edit.refresh()
+}
+
+func (edit *editLine) insert(text []rune) {
+	edit.line = slices.Insert(edit.line, edit.cursor, text...)
+	edit.cursor += len(text)
+	edit.refresh()
+}
+
+func (edit *editLine) delete(from, to int) {
+	from, to = max(0, from), min(to, len(edit.line))
+	if from >= to {
+		return
+	}
+	edit.line = slices.Delete(edit.line, from, to)
+	edit.cursor = from
+	edit.refresh()
+}
+
+// wordStart is where the word before the cursor starts.
+func (edit *editLine) wordStart() int {
+	start := edit.cursor
+	for start > 0 && unicode.IsSpace(edit.line[start-1]) {
+		start--
+	}
+	for start > 0 && !unicode.IsSpace(edit.line[start-1]) {
+		start--
+	}
+	return start
+}
+
+// recall shows history entry index in place of the line being edited.
+func (edit *editLine) recall(index int) {
+	history := edit.editor.history
+	if index < 0 || index > len(history) || index == edit.index {
+		return
+	}
+	if edit.index == len(history) {
+		edit.draft = edit.line
+	}
+	edit.index = index
+	if index == len(history) {
+		edit.line = edit.draft
+	} else {
+		edit.line = []rune(history[index])
+	}
+	edit.cursor = len(edit.line)
+	edit.refresh()
+}
+
+// complete finishes the word before the cursor as far as every candidate
+// agrees, listing them if that doesn't get any further.
+func (edit *editLine) complete() {
+	if edit.editor.complete == nil {
+		return
+	}
+	start := edit.cursor
+	for start > 0 && !unicode.IsSpace(edit.line[start-1]) {
+		start--
+	}
+	word := string(edit.line[start:edit.cursor])
+	candidates := []string{}
+	for _, candidate := range edit.editor.complete(string(edit.line[:start]), word) {
+		if strings.HasPrefix(candidate, word) && !slices.Contains(candidates, candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	slices.Sort(candidates)
+	if len(candidates) == 0 {
+		fmt.Fprint(edit.editor.out, "\a")
+		return
+	}
+	prefix := []rune(candidates[0])
+	for _, candidate := range candidates[1:] {
+		prefix = commonPrefix(prefix, []rune(candidate))
+	}
+	if len(candidates) == 1 && !strings.HasSuffix(candidates[0], string(filepath.Separator)) {
+		prefix = append(prefix, ' ')
+	}
+	if added := prefix[len([]rune(word)):]; len(added) > 0 {
+		edit.insert(added)
+		return
+	}
+	fmt.Fprintf(edit.editor.out, "\n%v\n", strings.Join(candidates, "  "))
+	edit.refresh()
+}
+
+func commonPrefix(a, b []rune) []rune {
+	length := 0
+	for length < len(a) && length < len(b) && a[length] == b[length] {
+		length++
+	}
+	return a[:length]
+}
@@ -1,34 +1,77 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const APP_NAME = "wafer"
 
-func printUsage() {
+// Exit statuses, following sysexits.h.
+const (
+	exitUsage      = 64 // the command line was wrong
+	exitDataErr    = 65 // a script has syntax errors, or check found problems
+	exitNoInput    = 66 // a script couldn't be read
+	exitSoftware   = 70 // a script failed while running
+	exitCantCreate = 73 // an output file couldn't be written
+)
+
+// printUsage prints how to run wafer, to stdout when it's asked for and to
+// stderr after a mistake.
+func printUsage(out *os.File) {
 	exeName := APP_NAME
 	if exePath, err := os.Executable(); err == nil {
 		exeName = filepath.Base(exePath)
 	}
-	fmt.Printf("Usage: %v <filename>\n", exeName)
+	fmt.Fprintf(out, "Usage: %v [options] [-e <code> | filename | -]...\n", exeName)
+	fmt.Fprintf(out, "       %v [options] check <filename>\n", exeName)
+	fmt.Fprintf(out, "       %v [options] calc\n", exeName)
+	fmt.Fprintf(out, "       %v fmt [--check|--diff] <filename>...\n", exeName)
+	fmt.Fprintf(out, "       %v build [-o <output>] <filename>\n", exeName)
+	fmt.Fprintln(out, "Options:")
+	flag.CommandLine.SetOutput(out)
+	flag.PrintDefaults()
+	flag.CommandLine.SetOutput(os.Stderr)
 }
 
-func loadStdLib() (words map[string]Word, err error) {
-	lexState := lex("stdlib", STDLIB)
-	if lexState.err != nil {
-		err = lexState.err
-		return
+// parseFlags parses args into flags, printing usage itself rather than
+// leaving it to the flag package, which would print it again on every
+// mistake. It reports whether to carry on, and the status to exit with if not.
+func parseFlags(flags *flag.FlagSet, args []string) (int, bool) {
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		printUsage(os.Stdout)
+		return 0, false
+	} else if err != nil {
+		printUsage(os.Stderr)
+		return exitUsage, false
 	}
+	return 0, true
+}
 
-	parseState := parse(lexState)
+// printError prints an error to stderr in the format asked for, showing the
+// source around any diagnostics in it by default.
+func printError(err error, options Options) {
+	printDiagnostics(os.Stderr, err, options.errorFormat)
+}
+
+func loadStdLib(cache bool) (words *Dictionary, err error) {
+	var parseState ParseState
+	if cache {
+		parseState = parseCached("stdlib", strings.NewReader(STDLIB), 0)
+	} else {
+		parseState = parse(lex("stdlib", strings.NewReader(STDLIB), 0))
+	}
 	if parseState.err != nil {
 		err = parseState.err
 		return
 	}
-	evalState := eval(parseState, make(map[string]Word))
+	evalState := eval(parseState, newDictionary(), Options{})
 	if !evalState.lastPrintedWasNewline {
 		fmt.Print("\n")
 	}
@@ -39,48 +82,282 @@ func loadStdLib() (words map[string]Word, err error) {
 	return
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		printUsage()
-		return
+// runCheck prints the stack effect of every definition in a script, along with
+// any problems found without running it.
+func runCheck(filename string, options Options) int {
+	parseState, err := loadScript(filename, options)
+	if err != nil {
+		printError(fmt.Errorf("failed to read file: %w", err), options)
+		return exitNoInput
+	} else if parseState.err != nil {
+		printError(parseState.err, options)
+		return exitDataErr
+	}
+	defs, err := check(parseState, options)
+	for _, def := range defs {
+		fmt.Println(def)
+	}
+	if err != nil {
+		printError(err, options)
+		return exitDataErr
+	}
+	return 0
+}
+
+// runFmt formats scripts in place. With --check it only lists the ones that
+// aren't formatted, and with --diff it shows what would change. Either way it
+// fails with status 1 if anything isn't formatted, like gofmt -l.
+func runFmt(args []string, options Options) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	checkOnly := flags.Bool("check", false, "list files that aren't formatted instead of formatting them, and fail if there are any")
+	showDiff := flags.Bool("diff", false, "print the changes formatting would make instead of making them")
+	if status, ok := parseFlags(flags, args); !ok {
+		return status
+	} else if flags.NArg() < 1 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+
+	status := 0
+	for _, filename := range flags.Args() {
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			printError(fmt.Errorf("failed to read file: %w", err), options)
+			status = max(status, exitNoInput)
+			continue
+		}
+		formatted, err := formatSource(filename, source)
+		if err != nil {
+			printError(err, options)
+			status = max(status, exitDataErr)
+			continue
+		}
+		if formatted == string(source) {
+			continue
+		}
+		switch {
+		case *showDiff:
+			fmt.Print(unifiedDiff(filename, string(source), formatted))
+			status = max(status, 1)
+		case *checkOnly:
+			fmt.Println(filename)
+			status = max(status, 1)
+		default:
+			if err := os.WriteFile(filename, []byte(formatted), 0o644); err != nil {
+				printError(fmt.Errorf("failed to write file: %w", err), options)
+				status = max(status, exitCantCreate)
+			}
+		}
 	}
+	return status
+}
 
-	filename := os.Args[1]
-	data, err := os.ReadFile(filename)
+// runBuild parses a script ahead of time, writing it somewhere it can be run
+// from without parsing it again.
+func runBuild(args []string, options Options) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := flags.String("o", "", "where to write the built script, by default its name with a .wbc extension")
+	if status, ok := parseFlags(flags, args); !ok {
+		return status
+	} else if flags.NArg() != 1 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	filename := flags.Arg(0)
+	if *output == "" {
+		*output = buildOutput(filename)
+	}
+	parseState, err := loadScript(filename, Options{maxErrors: options.maxErrors})
 	if err != nil {
-		fmt.Printf("failed to read file: %v\n", err)
-		return
+		printError(fmt.Errorf("failed to read file: %w", err), options)
+		return exitNoInput
+	} else if parseState.err != nil {
+		printError(parseState.err, options)
+		return exitDataErr
+	}
+	if err := buildScript(parseState, *output); err != nil {
+		printError(fmt.Errorf("failed to write file: %w", err), options)
+		return exitCantCreate
+	}
+	return 0
+}
+
+// snippetFile is the file name given to code passed with -e, numbered from
+// the second run of them on.
+const snippetFile = "<-e>"
+
+// scriptArg is a script named on the command line, or code passed with -e.
+type scriptArg struct {
+	filename string
+	code     []string // each -e in a row, if it's code
+}
+
+// scriptArgs collects scripts and code in the order they're given.
+type scriptArgs []scriptArg
+
+func (scripts *scriptArgs) String() string {
+	return ""
+}
+
+func (scripts *scriptArgs) Set(code string) error {
+	if n := len(*scripts); n > 0 && (*scripts)[n-1].code != nil {
+		(*scripts)[n-1].code = append((*scripts)[n-1].code, code)
+	} else {
+		*scripts = append(*scripts, scriptArg{code: []string{code}})
+	}
+	return nil
+}
+
+// runScripts runs scripts and code passed with -e one after another, in the
+// order they were given, all sharing one stack and dictionary. It returns the
+// status to exit with.
+func runScripts(scripts []scriptArg, options Options, optimizeScript, dumpScript bool) int {
+	parseStates := []ParseState{}
+	snippets := 0
+	for _, script := range scripts {
+		if script.code == nil {
+			parseState, err := loadScript(script.filename, options)
+			if err != nil {
+				printError(fmt.Errorf("failed to read file: %w", err), options)
+				return exitNoInput
+			}
+			parseStates = append(parseStates, parseState)
+			continue
+		}
+		file := snippetFile
+		if snippets++; snippets > 1 {
+			file = fmt.Sprintf("<-e%v>", snippets)
+		}
+		// each -e is a line of its own, like in perl
+		source := strings.Join(script.code, "\n")
+		scriptSources[file] = source
+		parseStates = append(parseStates, parse(lex(file, strings.NewReader(source), options.maxErrors)))
 	}
-	contents := string(data)
 
-	words, err := loadStdLib()
+	words, err := loadStdLib(options.cache)
 	if err != nil {
-		fmt.Println(err)
+		printError(err, options)
+		return exitSoftware
 	}
 
-	lexState := lex(filename, contents)
-	if lexState.err != nil {
-		fmt.Println(lexState.err)
-		return
+	// nothing runs unless every script parses
+	status := 0
+	for _, parseState := range parseStates {
+		if parseState.err != nil {
+			printError(parseState.err, options)
+			status = exitDataErr
+		}
+	}
+	if status != 0 {
+		return status
 	}
 
-	parseState := parse(lexState)
-	if parseState.err != nil {
-		fmt.Println(parseState.err)
-		return
+	if optimizeScript {
+		for _, parseState := range parseStates {
+			if skipped := optimize(parseState.root, words); skipped != "" && dumpScript {
+				fmt.Printf("# not optimized: %v %v\n", parseState.file, skipped)
+			}
+		}
+	}
+	if dumpScript {
+		for _, parseState := range parseStates {
+			dump(parseState.root)
+		}
+		return 0
 	}
 
-	evalState := eval(parseState, words)
+	evalState := eval(parseStates[0], words, options)
+	for _, parseState := range parseStates[1:] {
+		if evalState.err != nil {
+			break
+		}
+		evalState.evalNext(parseState.root)
+	}
 	if !evalState.lastPrintedWasNewline {
 		fmt.Print("\n")
 	}
-	if evalState.err != nil {
-		token := evalState.currentToken()
-		if token == nil {
-			fmt.Printf("%v:?:?:E: %v\n", filename, evalState.err)
-			return
+	var exit *ExitError
+	if errors.As(evalState.err, &exit) {
+		return exit.status
+	} else if evalState.err != nil {
+		printError(evalState.err, options)
+		return exitSoftware
+	}
+	return 0
+}
+
+// isSubcommand reports whether arg names a subcommand rather than a script. A
+// script with the same name can be run by its path, like `./check`.
+func isSubcommand(arg string) bool {
+	switch arg {
+	case "check", "fmt", "build", "calc":
+		return true
+	}
+	return false
+}
+
+func main() {
+	redefine := flag.String("redefine", "warn", "how to treat definitions that shadow builtins: `allow|warn|forbid`")
+	engine := flag.String("engine", "vm", "how to run scripts: `vm|tree`")
+	optimizeScript := flag.Bool("O", false, "fold constants, inline short definitions and remove dead code before running")
+	dumpScript := flag.Bool("dump", false, "print the script as it would be run, after any optimization, instead of running it")
+	cache := flag.Bool("cache", true, "keep parsed scripts in the user cache directory, and reuse them while the script is unchanged")
+	maxErrors := flag.Int("max-errors", 20, "maximum number of syntax errors to report, 0 for no limit")
+	errorFormat := flag.String("error-format", "human", "how to print errors and warnings: `human|json`")
+	var scripts scriptArgs
+	flag.Var(&scripts, "e", "run `code`; can be given more than once, and runs in order with any scripts")
+	flag.CommandLine.Init(APP_NAME, flag.ContinueOnError)
+	if status, ok := parseFlags(flag.CommandLine, os.Args[1:]); !ok {
+		os.Exit(status)
+	}
+
+	subcommand := flag.Arg(0)
+	if !isSubcommand(subcommand) {
+		subcommand = ""
+		// flags can come between scripts too, so -e runs where it's written
+		for flag.NArg() > 0 {
+			scripts = append(scripts, scriptArg{filename: flag.Arg(0)})
+			if status, ok := parseFlags(flag.CommandLine, flag.Args()[1:]); !ok {
+				os.Exit(status)
+			}
 		}
-		fmt.Println(evalState.err)
-		return
 	}
+
+	policy, err := parseRedefinePolicy(*redefine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	options := Options{redefine: policy, maxErrors: *maxErrors, cache: *cache}
+	if options.engine, err = parseEngine(*engine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	if options.errorFormat, err = parseErrorFormat(*errorFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	switch subcommand {
+	case "fmt":
+		os.Exit(runFmt(flag.Args()[1:], options))
+	case "build":
+		os.Exit(runBuild(flag.Args()[1:], options))
+	case "calc":
+		if flag.NArg() != 1 {
+			printUsage(os.Stderr)
+			os.Exit(exitUsage)
+		}
+		os.Exit(runCalc(options))
+	case "check":
+		if flag.NArg() != 2 {
+			printUsage(os.Stderr)
+			os.Exit(exitUsage)
+		}
+		os.Exit(runCheck(flag.Arg(1), options))
+	}
+	if len(scripts) == 0 {
+		os.Exit(runRepl(options))
+	}
+	os.Exit(runScripts(scripts, options, *optimizeScript, *dumpScript))
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runCommand runs fn the way main would, returning the status it exits with
+// and what it printed to stdout and stderr.
+func runCommand(t *testing.T, fn func() int) (status int, stdout, stderr string) {
+	t.Helper()
+	errFile, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = errFile
+	defer func() { os.Stderr = saved }()
+	stdout = captureStdout(t, func() { status = fn() })
+	errFile.Close()
+	data, err := os.ReadFile(errFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, stdout, string(data)
+}
+
+// writeScripts writes each script to a file of its name in a new directory,
+// returning the directory.
+func writeScripts(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, source := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRunScriptsStatus(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"ok.w":      `"hi" println`,
+		"exit.w":    `"before" println 3 exit "after" println`,
+		"exit0.w":   `0 exit "after" println`,
+		"nested.w":  `: f 42 exit ; f`,
+		"syntax.w":  `: f`,
+		"runtime.w": `1 "x" +`,
+	})
+	tests := []struct {
+		file   string
+		status int
+		output string
+	}{
+		{"ok.w", 0, "hi\n"},
+		{"exit.w", 3, "before\n"},
+		{"exit0.w", 0, ""},
+		{"nested.w", 42, ""},
+		{"syntax.w", exitDataErr, ""},
+		{"runtime.w", exitSoftware, ""},
+		{"missing.w", exitNoInput, ""},
+	}
+	for _, test := range tests {
+		status, output, _ := runCommand(t, func() int {
+			return runScripts([]scriptArg{{filename: filepath.Join(dir, test.file)}}, Options{}, false, false)
+		})
+		if status != test.status || output != test.output {
+			t.Errorf("%v exited with %v, printing %q, want %v and %q", test.file, status, output, test.status, test.output)
+		}
+	}
+}
+
+func TestRunCheckStatus(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"ok.w":      `: inc 1 + ;`,
+		"problem.w": `: f 1 "x" + ;`,
+		"syntax.w":  `: f`,
+	})
+	tests := []struct {
+		file   string
+		status int
+	}{
+		{"ok.w", 0},
+		{"problem.w", exitDataErr},
+		{"syntax.w", exitDataErr},
+		{"missing.w", exitNoInput},
+	}
+	for _, test := range tests {
+		status, _, _ := runCommand(t, func() int { return runCheck(filepath.Join(dir, test.file), Options{}) })
+		if status != test.status {
+			t.Errorf("check %v exited with %v, want %v", test.file, status, test.status)
+		}
+	}
+}
+
+func TestRunFmtStatus(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"formatted.w":   "1 2 +\n",
+		"unformatted.w": "1   2 +",
+		"syntax.w":      ": f",
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{path("formatted.w")}, 0},
+		{[]string{"--check", path("formatted.w")}, 0},
+		{[]string{"--check", path("unformatted.w")}, 1},
+		{[]string{"--diff", path("unformatted.w")}, 1},
+		{[]string{path("syntax.w")}, exitDataErr},
+		{[]string{path("missing.w")}, exitNoInput},
+		{[]string{"--check", path("missing.w"), path("unformatted.w")}, exitNoInput},
+		{[]string{}, exitUsage},
+		{[]string{"--nope", path("formatted.w")}, exitUsage},
+	}
+	for _, test := range tests {
+		status, _, _ := runCommand(t, func() int { return runFmt(test.args, Options{}) })
+		if status != test.status {
+			t.Errorf("fmt %v exited with %v, want %v", strings.Join(test.args, " "), status, test.status)
+		}
+	}
+}
+
+func TestRunBuildStatus(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"ok.w":     "1 2 +",
+		"syntax.w": ": f",
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{path("ok.w")}, 0},
+		{[]string{"-o", path("out.wbc"), path("ok.w")}, 0},
+		{[]string{"-o", path("no/such/dir/out.wbc"), path("ok.w")}, exitCantCreate},
+		{[]string{path("syntax.w")}, exitDataErr},
+		{[]string{path("missing.w")}, exitNoInput},
+		{[]string{path("ok.w"), path("ok.w")}, exitUsage},
+		{[]string{}, exitUsage},
+	}
+	for _, test := range tests {
+		status, _, _ := runCommand(t, func() int { return runBuild(test.args, Options{}) })
+		if status != test.status {
+			t.Errorf("build %v exited with %v, want %v", strings.Join(test.args, " "), status, test.status)
+		}
+	}
+}
+
+// TestScriptArgs checks that -e given several times in a row makes one
+// snippet, while a script in between starts another.
+func TestScriptArgs(t *testing.T) {
+	var scripts scriptArgs
+	scripts.Set("1")
+	scripts.Set("2")
+	scripts = append(scripts, scriptArg{filename: "a.w"})
+	scripts.Set("3")
+	want := []scriptArg{{code: []string{"1", "2"}}, {filename: "a.w"}, {code: []string{"3"}}}
+	if len(scripts) != len(want) {
+		t.Fatalf("got %v, want %v", scripts, want)
+	}
+	for i := range want {
+		if scripts[i].filename != want[i].filename || !slices.Equal(scripts[i].code, want[i].code) {
+			t.Errorf("script %v is %v, want %v", i, scripts[i], want[i])
+		}
+	}
+}
+
+// TestRunScriptsInOrder checks that scripts, code passed with -e and standard
+// input run in the order they're given, sharing one stack and dictionary.
+func TestRunScriptsInOrder(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"define.w": `: twice 2 * ;`,
+		"print.w":  `println`,
+	})
+	read, write, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdin
+	os.Stdin = read
+	defer func() { os.Stdin = saved }()
+	go func() {
+		write.WriteString("twice\n")
+		write.Close()
+	}()
+
+	scripts := []scriptArg{
+		{filename: filepath.Join(dir, "define.w")},
+		{code: []string{`"first" println`, "5"}},
+		{filename: "-"},
+		{filename: filepath.Join(dir, "print.w")},
+		{code: []string{"1 twice println"}},
+	}
+	status, output, stderr := runCommand(t, func() int { return runScripts(scripts, Options{}, false, false) })
+	if status != 0 || output != "first\n10\n2\n" {
+		t.Errorf("exited with %v, printing %q and %q", status, output, stderr)
+	}
+}
+
+// TestRunScriptsErrors checks that nothing runs if any script has a syntax
+// error, and that each -e is named for its place in errors.
+func TestRunScriptsErrors(t *testing.T) {
+	scripts := []scriptArg{
+		{code: []string{`"ran" println`}},
+		{filename: filepath.Join(writeScripts(t, map[string]string{"a.w": "1"}), "a.w")},
+		{code: []string{"1", ": f"}},
+	}
+	status, output, stderr := runCommand(t, func() int {
+		return runScripts(scripts, Options{errorFormat: ErrorFormatJSON}, false, false)
+	})
+	if status != exitDataErr || output != "" {
+		t.Errorf("exited with %v, printing %q, want %v and nothing", status, output, exitDataErr)
+	}
+	if !strings.Contains(stderr, `"file":"<-e2>","line":2`) {
+		t.Errorf("printed %q, want an error in the second -e", stderr)
+	}
+}
+
+// TestIsSubcommand checks subcommands are recognised by name alone, even with
+// a file of the same name in the way.
+func TestIsSubcommand(t *testing.T) {
+	t.Chdir(writeScripts(t, map[string]string{"check": `"script" println`}))
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{"check", true},
+		{"fmt", true},
+		{"build", true},
+		{"calc", true},
+		{"./check", false},
+		{"check.w", false},
+		{"-", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isSubcommand(test.arg); got != test.want {
+			t.Errorf("isSubcommand(%q) = %v, want %v", test.arg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxInline is the longest body, in tokens, that gets inlined.
+const maxInline = 8
+
+// pureCategories are the builtin categories whose words only work on the
+// values they're given, so they can be run ahead of time.
+var pureCategories = map[string]bool{
+	"arithmetic": true,
+	"boolean":    true,
+	"math":       true,
+	"stack":      true,
+	"string":     true,
+}
+
+// Optimizer rewrites a parsed script before it runs. It folds pure builtins
+// applied to constants, inlines short definitions, and removes code that can
+// never run. It assumes words aren't redefined, so any name defined more than
+// once is left alone.
+type Optimizer struct {
+	words    *Dictionary       // what's defined before the script runs
+	defs     map[string]int    // how many times the script defines each name
+	inline   map[string]*Token // definitions that can be inlined
+	bodies   map[*Token][]Token
+	inlining map[*Token]bool
+	pure     map[string]Builtin
+}
+
+func newOptimizer(words *Dictionary) *Optimizer {
+	opt := &Optimizer{
+		words:    words,
+		defs:     make(map[string]int),
+		inline:   make(map[string]*Token),
+		bodies:   make(map[*Token][]Token),
+		inlining: make(map[*Token]bool),
+		pure:     make(map[string]Builtin),
+	}
+	for _, builtin := range GeneratedBuiltins {
+		if pureCategories[builtin.category] {
+			opt.pure[builtin.name] = builtin
+		}
+	}
+	return opt
+}
+
+func (opt *Optimizer) countDefs(token *Token) {
+	for i := range token.children {
+		child := &token.children[i]
+		if child.kind == TokenDef {
+			opt.defs[child.value.text]++
+		}
+		opt.countDefs(child)
+	}
+}
+
+// findInlinable picks out the definitions that are made exactly once, either
+// at the top of the script or before it, and don't shadow a builtin.
+func (opt *Optimizer) findInlinable(root *Token) {
+	for i := range root.children {
+		child := &root.children[i]
+		if child.kind == TokenDef && opt.defs[child.value.text] == 1 {
+			if _, ok := opt.words.lookup(child.value.text); !ok {
+				opt.inline[child.value.text] = child
+			}
+		}
+	}
+	for name, slot := range opt.words.slots {
+		word := opt.words.words[slot]
+		if word.token != nil && opt.defs[name] == 0 {
+			opt.inline[name] = word.token
+		}
+	}
+}
+
+func isConstant(token *Token) bool {
+	return token.kind == TokenNumber || token.kind == TokenString
+}
+
+// fold runs the word at the end of out ahead of time if it's a pure builtin
+// and every value it takes is a constant just before it.
+func (opt *Optimizer) fold(out *[]Token) {
+	tokens := *out
+	word := tokens[len(tokens)-1]
+	builtin, ok := opt.pure[word.value.text]
+	if !ok || opt.defs[word.value.text] > 0 {
+		return
+	} else if defined, _ := opt.words.lookup(word.value.text); defined.builtin == nil {
+		return
+	}
+	inputs := int(builtin.inputs[0] - '0')
+	start := len(tokens) - 1 - inputs
+	if start < 0 {
+		return
+	}
+	scratch := EvalState{}
+	for i := start; i < len(tokens)-1; i++ {
+		if !isConstant(&tokens[i]) {
+			return
+		}
+		scratch.values.Push(tokens[i].value)
+	}
+	if builtin.proc(&scratch) != nil {
+		return // leave it to fail at runtime, with the usual error
+	}
+	first := tokens[start]
+	if inputs == 0 {
+		first = word
+	}
+	tokens = tokens[:start]
+	for _, value := range scratch.values.Items() {
+		folded := first
+		folded.kind = TokenNumber
+		if value.kind == ValueText {
+			folded.kind = TokenString
+		}
+		folded.value = value
+		tokens = append(tokens, folded)
+	}
+	*out = tokens
+}
+
+func (opt *Optimizer) body(def *Token) []Token {
+	if body, ok := opt.bodies[def]; ok {
+		return body
+	}
+	opt.inlining[def] = true
+	body := opt.optimizeBody(def.children)
+	delete(opt.inlining, def)
+	opt.bodies[def] = body
+	return body
+}
+
+// inlineBody returns the body to use in place of a call to name, if it's short
+// enough and doesn't call itself.
+func (opt *Optimizer) inlineBody(name string) ([]Token, bool) {
+	def, ok := opt.inline[name]
+	if !ok || def.signature != nil || opt.inlining[def] {
+		return nil, false
+	}
+	body := opt.body(def)
+	if len(body) > maxInline {
+		return nil, false
+	}
+	for i := range body {
+		token := &body[i]
+		if token.kind != TokenNumber && token.kind != TokenString && token.kind != TokenWord {
+			return nil, false
+		} else if token.kind == TokenWord && token.value.text == name {
+			return nil, false
+		}
+	}
+	return body, true
+}
+
+// exits reports whether token calls the `exit` builtin, which never returns
+// whether or not it succeeds.
+func (opt *Optimizer) exits(token *Token) bool {
+	if token.value.text != "exit" || opt.defs["exit"] > 0 {
+		return false
+	}
+	word, _ := opt.words.lookup("exit")
+	return word.builtin != nil
+}
+
+// addLoop drops loops that never run and unwraps those that run exactly
+// once. It reports whether the loop never finishes once it starts.
+func (opt *Optimizer) addLoop(out *[]Token, loop *Token, body []Token) bool {
+	tokens := *out
+	var cond *Token
+	if len(tokens) > 0 && tokens[len(tokens)-1].kind == TokenNumber {
+		cond = &tokens[len(tokens)-1]
+	}
+	var last *Token
+	if len(body) > 0 && body[len(body)-1].kind == TokenNumber {
+		last = &body[len(body)-1]
+	}
+	if cond != nil && cond.value.number == 0 {
+		*out = tokens[:len(tokens)-1]
+		return false
+	} else if cond != nil && last != nil && last.value.number == 0 {
+		*out = tokens[:len(tokens)-1]
+		for i := range body[:len(body)-1] {
+			if opt.addOptimized(out, &body[i]) {
+				return true
+			}
+		}
+		return false
+	}
+	copied := *loop
+	copied.children = body
+	*out = append(tokens, copied)
+	return cond != nil && last != nil
+}
+
+// add appends token to out, optimizing it on the way. It reports whether
+// token never finishes, making anything after it dead code.
+func (opt *Optimizer) add(out *[]Token, token *Token) bool {
+	switch token.kind {
+	case TokenWord:
+		if body, ok := opt.inlineBody(token.value.text); ok {
+			for i := range body {
+				// remembered so errors in it have the backtrace they would
+				// without inlining
+				inlined := body[i]
+				inlined.inlined = append(slices.Clip(inlined.inlined), token)
+				if opt.addOptimized(out, &inlined) {
+					return true
+				}
+			}
+			return false
+		}
+		*out = append(*out, *token)
+		opt.fold(out)
+		return opt.exits(token)
+	case TokenDef:
+		copied := *token
+		copied.children = opt.body(token)
+		*out = append(*out, copied)
+	case TokenLoop:
+		return opt.addLoop(out, token, opt.optimizeBody(token.children))
+	default:
+		*out = append(*out, *token)
+	}
+	return false
+}
+
+// addOptimized appends a token that has already been optimized, only
+// folding it into the tokens before it.
+func (opt *Optimizer) addOptimized(out *[]Token, token *Token) bool {
+	switch token.kind {
+	case TokenWord:
+		*out = append(*out, *token)
+		opt.fold(out)
+		return opt.exits(token)
+	case TokenLoop:
+		return opt.addLoop(out, token, token.children)
+	default:
+		*out = append(*out, *token)
+	}
+	return false
+}
+
+func (opt *Optimizer) optimizeBody(children []Token) []Token {
+	out := make([]Token, 0, len(children))
+	for i := range children {
+		if opt.add(&out, &children[i]) {
+			break
+		}
+	}
+	return out
+}
+
+// optimize rewrites the script in place. Scripts that run or define code
+// while running can't be optimized, since their words might change under
+// them; it returns the reason in that case.
+func optimize(root *Token, words *Dictionary) (skipped string) {
+	if name, ok := dynamicWord(root); ok {
+		return fmt.Sprintf("uses `%v`", name)
+	}
+	opt := newOptimizer(words)
+	opt.countDefs(root)
+	opt.findInlinable(root)
+	root.children = opt.optimizeBody(root.children)
+	return ""
+}
+
+func formatNumber(number float64) string {
+	switch {
+	case math.IsInf(number, 1):
+		return "inf"
+	case math.IsInf(number, -1):
+		return "-inf"
+	case math.IsNaN(number):
+		return "nan"
+	}
+	if number == math.Trunc(number) && math.Abs(number) < 1e21 {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(number, 'g', -1, 64)
+}
+
+func quoteString(text string) string {
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for _, c := range text {
+		switch c {
+		case '"', '\\':
+			builder.WriteByte('\\')
+			builder.WriteRune(c)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\t':
+			builder.WriteString(`\t`)
+		case '\r':
+			builder.WriteString(`\r`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&builder, `\x%02x`, c)
+			} else {
+				builder.WriteRune(c)
+			}
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+// formatTokens writes tokens back out as source, for -dump.
+func formatTokens(tokens []Token) string {
+	parts := []string{}
+	for i := 0; i < len(tokens); i++ {
+		token := &tokens[i]
+		switch token.kind {
+		case TokenNumber:
+			parts = append(parts, formatNumber(token.value.number))
+		case TokenString:
+			parts = append(parts, quoteString(token.value.text))
+		case TokenWord:
+			parts = append(parts, token.value.text)
+		case TokenDef:
+			def := ": " + token.value.text
+			if token.signature != nil {
+				def += " " + token.signature.String()
+			}
+			if body := formatTokens(token.children); body != "" {
+				def += " " + body
+			}
+			parts = append(parts, def+" ;")
+		case TokenLoop:
+			parts = append(parts, "{ "+formatTokens(token.children)+" }")
+		case TokenInterpBegin:
+			end := i + 1
+			for tokens[end].kind != TokenInterpEnd {
+				end++
+			}
+			parts = append(parts, formatInterp(tokens[i+1:end]))
+			i = end
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatInterp(tokens []Token) string {
+	var builder strings.Builder
+	builder.WriteString(`f"`)
+	segment := []Token{}
+	for _, token := range tokens {
+		switch token.kind {
+		case TokenInterpHole:
+			builder.WriteString("{}")
+		case TokenInterpAppend:
+			if len(segment) == 1 && segment[0].kind == TokenString {
+				text := quoteString(segment[0].value.text)
+				builder.WriteString(strings.NewReplacer("{", "{{", "}", "}}").Replace(text[1 : len(text)-1]))
+			} else {
+				builder.WriteString("{" + formatTokens(segment) + "}")
+			}
+			segment = segment[:0]
+		default:
+			segment = append(segment, token)
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+// dump prints an optimized script, with each definition on its own line.
+func dump(root *Token) {
+	line := []Token{}
+	for _, token := range root.children {
+		if token.kind != TokenDef {
+			line = append(line, token)
+			continue
+		}
+		if len(line) > 0 {
+			fmt.Println(formatTokens(line))
+			line = line[:0]
+		}
+		fmt.Println(formatTokens([]Token{token}))
+	}
+	if len(line) > 0 {
+		fmt.Println(formatTokens(line))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		source    string
+		optimized string
+	}{
+		// constant folding
+		{"2 3 + print", "5 print"},
+		{"2 3 * 4 + print", "10 print"},
+		{`"a" "b" strconcat print`, `"ab" print`},
+		{"1 2 swap print print", "2 1 print print"},
+		{"x 1 +", "x 1 +"},
+		// pure builtins that fail at run time are left to fail there
+		{`"x" 1 + print`, `"x" 1 + print`},
+		// stdlib words are inlined too
+		{"5 println", `5 print "\n" print`},
+		// inlining short definitions, and folding what they leave
+		{": sq dup * ; 3 sq print", ": sq dup * ; 9 print"},
+		{": two 2 ; two two + print", ": two 2 ; 4 print"},
+		// code that can never run
+		{"0 { 1 print 0 } 2 print", "2 print"},
+		// redefined words are left alone
+		{": two 2 ; : two 3 ; two print", ": two 2 ; : two 3 ; two print"},
+	}
+	for _, test := range tests {
+		words, err := loadStdLib(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseState := parseSource(test.source, 0)
+		if parseState.err != nil {
+			t.Fatal(parseState.err)
+		}
+		optimize(parseState.root, words)
+		if got := formatTokens(parseState.root.children); got != test.optimized {
+			t.Errorf("%q optimized to %q, want %q", test.source, got, test.optimized)
+		}
+	}
+}
+
+func TestOptimizeSkipsDynamic(t *testing.T) {
+	for _, word := range []string{"runstring", "runfile", "forget", "marker"} {
+		words, err := loadStdLib(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := `2 3 + "x" ` + word
+		parseState := parseSource(source, 0)
+		if skipped := optimize(parseState.root, words); skipped == "" {
+			t.Errorf("%q was optimized", source)
+		} else if got := formatTokens(parseState.root.children); got != source {
+			t.Errorf("%q changed to %q", source, got)
+		}
+	}
+}
+
+// TestOptimizedErrors checks that errors in inlined code are reported where
+// they would be without -O, with the same backtrace.
+func TestOptimizedErrors(t *testing.T) {
+	sources := []string{
+		`"x" ++`,
+		`: inc ++ ; : go "x" inc ; go`,
+		`: twice dup + ; "x" twice`,
+		`: f 1 swap - ; : g f f ; 1 { "x" g 0 }`,
+	}
+	for _, engine := range engines {
+		for _, source := range sources {
+			_, want := runSource(t, source, Options{engine: engine})
+			_, err := runOptimized(t, source, Options{engine: engine}, true)
+			if want == nil || err == nil || err.Error() != want.Error() {
+				t.Errorf("%v: %q failed with\n%v\nwith -O, want\n%v", engine, source, err, want)
+			}
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
 type ValueKind int
@@ -27,6 +32,21 @@ type Value struct {
 	text   string
 }
 
+func (value Value) String() string {
+	if value.kind == ValueNumber {
+		return fmt.Sprint(value.number)
+	}
+	return value.text
+}
+
+// literal writes value the way it would be written in a script.
+func (value Value) literal() string {
+	if value.kind == ValueNumber {
+		return formatNumber(value.number)
+	}
+	return quoteString(value.text)
+}
+
 type TokenKind int
 
 const (
@@ -36,6 +56,10 @@ const (
 	TokenWord
 	TokenDef
 	TokenLoop
+	TokenInterpBegin
+	TokenInterpAppend
+	TokenInterpHole
+	TokenInterpEnd
 )
 
 func (kind TokenKind) String() string {
@@ -52,6 +76,8 @@ func (kind TokenKind) String() string {
 		return "definition"
 	case TokenLoop:
 		return "loop"
+	case TokenInterpBegin, TokenInterpAppend, TokenInterpHole, TokenInterpEnd:
+		return "interpolation"
 	}
 	return "unknown"
 }
@@ -64,39 +90,55 @@ type Token struct {
 	file     string
 	line     int
 	col      int
+	endLine  int // where the token ends, just past its last rune
+	endCol   int
+	// declared with a stack-effect comment straight after a definition's name
+	signature *Signature
+	code      *Code    // the compiled body, once the VM has run it
+	inlined   []*Token // the calls -O inlined this token from, innermost first
 }
 
 type ParseState struct {
-	lexemes []Lexeme
-	index   int
+	*Diagnostics
+	lexer   *LexState
+	lexeme  Lexeme // the lexeme being parsed
+	more    bool   // false once the lexer has run out of lexemes
 	file    string
 	line    int
 	col     int
+	endLine int
+	endCol  int
 	err     error
 	scopes  Stack[*Token]
 	root    *Token
+	cutOff  int // how many scopes were still open at the end of the script
+	// set while inside an interpolated string, counting its `{}` holes
+	interpolating bool
+	holes         int
 }
 
-func newParseState(lexState LexState) ParseState {
+func newParseState(lexState *LexState) ParseState {
 	root := Token{kind: TokenRoot}
 	return ParseState{
-		lexemes: lexState.lexemes,
-		index:   0,
-		file:    lexState.file,
-		line:    -1,
-		col:     -1,
-		err:     lexState.err,
-		scopes:  Stack[*Token]{},
-		root:    &root,
+		Diagnostics: lexState.Diagnostics,
+		lexer:       lexState,
+		file:        lexState.file,
+		line:        -1,
+		col:         -1,
+		err:         nil,
+		scopes:      Stack[*Token]{},
+		root:        &root,
 	}
 }
 
 func (state *ParseState) addToken(kind TokenKind) *Token {
 	token := Token{
-		kind: kind,
-		file: state.file,
-		line: state.line,
-		col:  state.col,
+		kind:    kind,
+		file:    state.file,
+		line:    state.line,
+		col:     state.col,
+		endLine: state.endLine,
+		endCol:  state.endCol,
 	}
 	top, ok := state.scopes.Peek()
 	if ok {
@@ -110,95 +152,249 @@ func (state *ParseState) addToken(kind TokenKind) *Token {
 	}
 }
 
+// parseNumber converts the text of a number lexeme into its value.
+func parseNumber(text string) (float64, error) {
+	sign := 1.0
+	if text[0] == '-' || text[0] == '+' {
+		if text[0] == '-' {
+			sign = -1
+		}
+		text = text[1:]
+	}
+	text = strings.ReplaceAll(text, "_", "")
+	switch text {
+	case "inf":
+		return sign * math.Inf(1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	if len(text) > 2 && text[0] == '0' {
+		base := 0
+		switch text[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 0 {
+			value, ok := new(big.Int).SetString(text[2:], base)
+			if !ok {
+				return 0, strconv.ErrSyntax
+			}
+			number, _ := new(big.Float).SetInt(value).Float64()
+			return sign * number, nil
+		}
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	return sign * number, err
+}
+
 func (state *ParseState) handleNumber() {
-	lexeme := state.lexemes[state.index]
-	val, err := strconv.ParseFloat(lexeme.text, 64)
-	if err != nil {
-		state.Error("malformed number `%v`", lexeme.text)
+	lexeme := state.lexeme
+	val, err := parseNumber(lexeme.text)
+	if errors.Is(err, strconv.ErrRange) {
+		state.Error(CodeNumberRange, "number out of range `%v`", lexeme.text)
+		state.advance()
+		return
+	} else if err != nil {
+		state.Error(CodeBadNumber, "malformed number `%v`", lexeme.text)
+		state.advance()
 		return
 	}
 	token := state.addToken(TokenNumber)
 	token.value = Value{kind: ValueNumber, number: val}
-	state.index++
+	state.advance()
 }
 
 func (state *ParseState) handleDefBegin() {
-	state.index++ // move past ':'
-	if state.index >= len(state.lexemes) {
-		state.Error("expected word after ':', got eof")
+	state.advance() // move past ':'
+	if !state.more {
+		state.Error(CodeMissingName, "expected word after ':', got eof")
 		return
 	}
 
-	word := state.lexemes[state.index]
+	token := state.addToken(TokenDef)
+	state.scopes.Push(token)
+	word := state.lexeme
 	if word.kind != LexemeWord {
-		word.Error("expected word after ':', got `%v`", word.kind)
+		// keep the definition open anyway, so its `;` doesn't cause more errors
+		state.line, state.col, state.endLine, state.endCol = word.line, word.col, word.endLine, word.endCol
+		state.Error(CodeMissingName, "expected word after ':', got `%v`", word.kind)
 		return
 	}
-
-	token := state.addToken(TokenDef)
 	token.value = Value{kind: ValueText, text: word.text}
-	state.scopes.Push(token)
-	state.index++
+	token.endLine, token.endCol = word.endLine, word.endCol
+	state.advance()
 }
 
-func (state *ParseState) handleDefEnd() {
-	top, ok := state.scopes.Pop()
-	if !ok {
-		state.Error("unexpected end of definition")
-		return
-	} else if top.kind != TokenDef {
-		state.Error("expected end of definition, got `%v`", top.kind)
+// reportUnclosed reports a scope left open before the closer of another one,
+// or the end of the file.
+func (state *ParseState) reportUnclosed(token *Token, before string) {
+	var diag *Diagnostic
+	switch token.kind {
+	case TokenDef:
+		diag = diagnosticAt(token, CodeUnclosed, "unclosed definition `%v`, expected `;` before %v", token.value.text, before)
+	case TokenLoop:
+		diag = diagnosticAt(token, CodeUnclosed, "unclosed loop, expected `}` before %v", before)
+	default:
 		return
 	}
-	state.index++
+	if state.more {
+		diag.withLabelAt(state.file, state.line, state.col, state.endLine, state.endCol, "%v found here", before)
+	}
+	state.report(&ParseError{*diag})
+}
+
+// reportUnexpected reports a closer with no scope of its kind to close,
+// pointing out the scope that's open instead, if any.
+func (state *ParseState) reportUnexpected(format string, args ...any) {
+	diag := newDiagnostic(CodeUnexpectedClose, state.file, state.line, state.col, format, args...).to(state.endLine, state.endCol)
+	if top, ok := state.scopes.Peek(); ok && top.kind == TokenLoop {
+		diag.withLabel(top, "loop opened here")
+	} else if ok && top.kind == TokenDef {
+		diag.withLabel(top, "definition `%v` opened here", top.value.text)
+	}
+	state.report(&ParseError{*diag})
+}
+
+// closeScope pops scopes up to and including the innermost one of the given
+// kind, reporting any left open in between. If there is no such scope it
+// returns false and leaves the scopes alone.
+func (state *ParseState) closeScope(kind TokenKind, closer string) bool {
+	found := false
+	for _, token := range state.scopes.Items() {
+		found = found || token.kind == kind
+	}
+	if !found {
+		return false
+	}
+	for {
+		top, _ := state.scopes.Pop()
+		if top.kind == kind {
+			return true
+		}
+		state.reportUnclosed(top, closer)
+	}
+}
+
+func (state *ParseState) handleDefEnd() {
+	if !state.closeScope(TokenDef, "`;`") {
+		state.reportUnexpected("unexpected end of definition")
+	}
+	state.advance()
 }
 
 func (state *ParseState) handleLoopEnd() {
-	top, ok := state.scopes.Pop()
-	if !ok {
-		state.Error("unexpected end of loop")
+	if !state.closeScope(TokenLoop, "`}`") {
+		state.reportUnexpected("unexpected end of loop")
+	}
+	state.advance()
+}
+
+func (state *ParseState) handleInterpBegin() {
+	lexeme := state.lexeme
+	holes, err := strconv.Atoi(lexeme.text)
+	if err != nil {
+		state.Error(CodeBadLexeme, "malformed interpolated string")
+		state.advance()
 		return
-	} else if top.kind != TokenLoop {
-		state.Error("expected end of loop, got `%v`", top.kind)
+	}
+	state.addToken(TokenInterpBegin).value = Value{kind: ValueNumber, number: float64(holes)}
+	state.interpolating = true
+	state.holes = 0
+	state.advance()
+}
+
+// handleStackComment attaches a stack-effect comment to the definition whose
+// name it follows. Anywhere else it's just a comment.
+func (state *ParseState) handleStackComment() {
+	top, ok := state.scopes.Peek()
+	if !ok || top.kind != TokenDef || top.signature != nil || len(top.children) > 0 {
+		state.advance()
 		return
 	}
-	state.index++
+	sig, err := parseSignature(state.lexeme.text)
+	if err != nil {
+		state.Error(CodeBadSignature, "%v", err)
+	}
+	top.signature = sig
+	state.advance()
 }
 
 func (state *ParseState) step() {
-	lexeme := state.lexemes[state.index]
-	state.line = lexeme.line
-	state.col = lexeme.col
+	lexeme := state.lexeme
+	state.line, state.col = lexeme.line, lexeme.col
+	state.endLine, state.endCol = lexeme.endLine, lexeme.endCol
 	switch lexeme.kind {
 	case LexemeNumber:
 		state.handleNumber()
 	case LexemeString:
 		state.addToken(TokenString).value = Value{kind: ValueText, text: lexeme.text}
-		state.index++
+		if state.interpolating {
+			state.addToken(TokenInterpAppend)
+		}
+		state.advance()
 	case LexemeWord:
 		state.addToken(TokenWord).value = Value{kind: ValueText, text: lexeme.text}
-		state.index++
+		if state.interpolating {
+			state.addToken(TokenInterpAppend).value = Value{kind: ValueText, text: lexeme.text}
+		}
+		state.advance()
 	case LexemeDefBegin:
 		state.handleDefBegin()
 	case LexemeDefEnd:
 		state.handleDefEnd()
 	case LexemeLoopBegin:
 		state.scopes.Push(state.addToken(TokenLoop))
-		state.index++
+		state.advance()
 	case LexemeLoopEnd:
 		state.handleLoopEnd()
+	case LexemeInterpBegin:
+		state.handleInterpBegin()
+	case LexemeInterpHole:
+		state.addToken(TokenInterpHole).value = Value{kind: ValueNumber, number: float64(state.holes)}
+		state.holes++
+		state.advance()
+	case LexemeInterpEnd:
+		state.addToken(TokenInterpEnd)
+		state.interpolating = false
+		state.advance()
+	case LexemeStackComment:
+		state.handleStackComment()
+	case LexemeComment:
+		state.advance()
 	default:
-		state.Error("unexpected lexeme in parsing stage: `%v`", lexeme.text)
+		state.Error(CodeBadLexeme, "unexpected lexeme in parsing stage: `%v`", lexeme.text)
+		state.advance()
 	}
 }
 
-func parse(lexState LexState) (state ParseState) {
+func (state *ParseState) advance() {
+	state.lexeme, state.more = state.lexer.next()
+}
+
+func parse(lexState *LexState) (state ParseState) {
 	state = newParseState(lexState)
-	if state.err != nil {
-		return
-	}
-	for state.index < len(state.lexemes) && state.err == nil {
+	state.advance()
+	for state.more && !state.full() {
 		state.step()
 	}
+	for _, token := range state.scopes.Items() {
+		state.reportUnclosed(token, "end of file")
+		state.cutOff++
+	}
+	state.err = state.result()
 	return
 }
+
+// incomplete reports whether the script's only errors are things still open
+// at its end, which more lines could close.
+func (state *ParseState) incomplete() bool {
+	cutOff := state.cutOff
+	if state.lexer.cutOff {
+		cutOff++
+	}
+	return state.err != nil && len(state.errs) == cutOff
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func parseSource(source string, maxErrors int) ParseState {
+	return parse(lex("test.w", strings.NewReader(source), maxErrors))
+}
+
+func TestParseNumbers(t *testing.T) {
+	tests := []struct {
+		source string
+		number float64
+	}{
+		{"42", 42},
+		{"-7", -7},
+		{"+7", 7},
+		{".5", 0.5},
+		{"3.14", 3.14},
+		{"1.5e-3", 1.5e-3},
+		{"2E+2", 200},
+		{"0xFF", 255},
+		{"-0x10", -16},
+		{"0b1010", 10},
+		{"0o17", 15},
+		{"1_000_000", 1e6},
+		{"0xdead_beef", 0xdeadbeef},
+		{"inf", math.Inf(1)},
+		{"-inf", math.Inf(-1)},
+	}
+	for _, test := range tests {
+		parseState := parseSource(test.source, 0)
+		if parseState.err != nil {
+			t.Errorf("%q failed: %v", test.source, parseState.err)
+		} else if children := parseState.root.children; len(children) != 1 || children[0].kind != TokenNumber {
+			t.Errorf("%q parsed to %v, want one number", test.source, children)
+		} else if children[0].value.number != test.number {
+			t.Errorf("%q parsed to %v, want %v", test.source, children[0].value.number, test.number)
+		}
+	}
+
+	if parseState := parseSource("nan", 0); parseState.err != nil || !math.IsNaN(parseState.root.children[0].value.number) {
+		t.Errorf("nan parsed to %v (%v)", parseState.root.children, parseState.err)
+	}
+	// words that only start like numbers
+	for _, source := range []string{"-", "+", "--", "-x", "infinity", "nano"} {
+		if parseState := parseSource(source, 0); parseState.err != nil || parseState.root.children[0].kind != TokenWord {
+			t.Errorf("%q parsed to %v (%v), want a word", source, parseState.root.children, parseState.err)
+		}
+	}
+}
+
+// TestParseRecovery checks that every error in a script is reported, not
+// just the first.
+func TestParseRecovery(t *testing.T) {
+	tests := []struct {
+		source string
+		codes  []ErrorCode
+	}{
+		{":", []ErrorCode{CodeMissingName}},
+		{": f 1", []ErrorCode{CodeUnclosed}},
+		{"1 {", []ErrorCode{CodeUnclosed}},
+		{"1 ;", []ErrorCode{CodeUnexpectedClose}},
+		{"}", []ErrorCode{CodeUnexpectedClose}},
+		{"1e999", []ErrorCode{CodeNumberRange}},
+		{": f ( a -- ) ;", nil},
+		{": f ( a b ) ;", nil}, // just a comment
+		{": f ( a -- b -- c ) ;", []ErrorCode{CodeBadSignature}},
+		{": f ( a:q -- ) ;", []ErrorCode{CodeBadSignature}},
+		{"} 1e999 ;", []ErrorCode{CodeUnexpectedClose, CodeNumberRange, CodeUnexpectedClose}},
+		// lexer and parser errors are reported together, in order
+		{"\"\\q\" } 0x\n: f {", []ErrorCode{CodeBadEscape, CodeUnexpectedClose, CodeBadNumber, CodeUnclosed, CodeUnclosed}},
+	}
+	for _, test := range tests {
+		parseState := parseSource(test.source, 0)
+		codes := []ErrorCode{}
+		for _, err := range unwrapErrors(parseState.err) {
+			codes = append(codes, errorCode(err))
+		}
+		if strings.Join(codeStrings(codes), " ") != strings.Join(codeStrings(test.codes), " ") {
+			t.Errorf("%q failed with %v (%v), want %v", test.source, codes, parseState.err, test.codes)
+		}
+	}
+}
+
+func TestParseMaxErrors(t *testing.T) {
+	source := strings.Repeat("} ", 10)
+	if errs := unwrapErrors(parseSource(source, 3).err); len(errs) != 4 || errs[3] != errTooManyErrors {
+		t.Errorf("reported %v with a limit of 3, want 3 errors and then %v", errs, errTooManyErrors)
+	}
+	if errs := unwrapErrors(parseSource(source, 0).err); len(errs) != 10 {
+		t.Errorf("reported %v errors with no limit, want 10: %v", len(errs), errs)
+	}
+}
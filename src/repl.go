@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ReplCommand is one of the REPL's own commands, which are typed on a line of
+// their own instead of code. Running one reports whether the REPL should stop
+// and the status to exit with if so.
+type ReplCommand struct {
+	name string
+	args string
+	help string
+	run  func(arg string) (int, bool)
+}
+
+// maxStackShown is how many values from the top of the stack are shown after
+// each entry.
+const maxStackShown = 10
+
+// Repl runs code as it's typed in, keeping the stack and definitions from one
+// entry to the next.
+type Repl struct {
+	state    EvalState
+	editor   *LineEditor
+	commands []ReplCommand
+	entries  int    // how many entries have been run, to name them in errors
+	show     func() // prints the stack after each entry
+	// changed is called after anything that might have changed the stack,
+	// with the stack as it was before and whether it succeeded.
+	changed func(before []Value, ok bool)
+}
+
+func newRepl(words *Dictionary, options Options) *Repl {
+	repl := &Repl{
+		state:  newEvalState(ParseState{root: &Token{kind: TokenRoot}}, words, options),
+		editor: newLineEditor(os.Stdin, os.Stdout),
+	}
+	// each entry is run as a script of its own, so the empty one isn't needed
+	repl.state.scopes.Pop()
+	repl.commands = []ReplCommand{
+		{".help", "", "show this help", repl.help},
+		{".stack", "", "show every value on the stack", repl.showAll},
+		{".clear", "", "empty the stack", repl.clear},
+		{".load", "<file>", "run a script, keeping what it defines", repl.load},
+		{".words", "", "list the words that are defined", repl.listWords},
+		{".quit", "", "leave, as does Ctrl-D", repl.quit},
+	}
+	repl.show = repl.showStack
+	repl.editor.complete = repl.complete
+	if path, ok := historyFile(); ok {
+		repl.editor.loadHistory(path)
+	}
+	return repl
+}
+
+// runRepl starts the REPL, returning the status to exit with once it's done.
+func runRepl(options Options) int {
+	words, err := loadStdLib(options.cache)
+	if err != nil {
+		printError(err, options)
+		return exitSoftware
+	}
+	return newRepl(words, options).loop(APP_NAME + " REPL, type .help for help")
+}
+
+// loop runs entries until the input ends, greeting the user with banner
+// first if they're at a terminal.
+func (repl *Repl) loop(banner string) int {
+	if repl.editor.terminal {
+		fmt.Println(banner)
+	}
+	for {
+		source, err := repl.readEntry()
+		if err == errInterrupted {
+			continue
+		} else if err != nil {
+			return 0
+		}
+		if status, done := repl.enter(source); done {
+			return status
+		}
+	}
+}
+
+// readEntry reads lines until they make up a whole entry, carrying on while a
+// definition, loop, comment or multiline string is left open.
+func (repl *Repl) readEntry() (string, error) {
+	lines := []string{}
+	prompt := "> "
+	for {
+		line, err := repl.editor.readLine(prompt)
+		if err == io.EOF && len(lines) > 0 {
+			// run what there is, so whatever is left open gets reported
+			return strings.Join(lines, "\n"), nil
+		} else if err != nil {
+			return "", err
+		}
+		repl.editor.addHistory(line)
+		lines = append(lines, line)
+		source := strings.Join(lines, "\n")
+		if _, ok := repl.command(line); len(lines) == 1 && ok {
+			return source, nil
+		}
+		if parseState := parse(lex("", strings.NewReader(source+"\n"), 0)); !parseState.incomplete() {
+			return source, nil
+		}
+		prompt = "... "
+	}
+}
+
+// command finds the command line runs, if it's one of the REPL's own.
+func (repl *Repl) command(line string) (*ReplCommand, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, false
+	}
+	for i := range repl.commands {
+		if repl.commands[i].name == fields[0] {
+			return &repl.commands[i], true
+		}
+	}
+	return nil, false
+}
+
+// enter runs an entry, reporting whether the REPL should stop and the status
+// to exit with if so.
+func (repl *Repl) enter(source string) (int, bool) {
+	if command, ok := repl.command(source); ok {
+		_, arg := cutString(strings.TrimSpace(source), " ")
+		return command.run(strings.TrimSpace(arg))
+	}
+	repl.entries++
+	file := fmt.Sprintf("<input %v>", repl.entries)
+	// kept so errors in it can be shown with its source, even from later entries
+	scriptSources[file] = source
+	return repl.run(parse(lex(file, strings.NewReader(source+"\n"), repl.state.options.maxErrors)))
+}
+
+func (repl *Repl) run(parseState ParseState) (int, bool) {
+	state := &repl.state
+	if parseState.err != nil {
+		printError(parseState.err, state.options)
+		return 0, false
+	}
+	before := slices.Clone(state.values.Items())
+	state.evalNext(parseState.root)
+	if !state.lastPrintedWasNewline {
+		fmt.Print("\n")
+		state.lastPrintedWasNewline = true
+	}
+	var exit *ExitError
+	if errors.As(state.err, &exit) {
+		return exit.status, true
+	}
+	ok := state.err == nil
+	if !ok {
+		printError(state.err, state.options)
+		repl.reset()
+	}
+	if repl.changed != nil {
+		repl.changed(before, ok)
+	}
+	repl.show()
+	return 0, false
+}
+
+// reset gets ready for the next entry after an error. The stack is left as
+// the failing word found it. Definitions hoisted from the entry that it never
+// reached are undone, since the code making them never ran.
+func (repl *Repl) reset() {
+	state := &repl.state
+	for token, prev := range state.hoisted {
+		state.words.set(token.value.text, prev)
+	}
+	clear(state.hoisted)
+	state.err = nil
+	state.scopes = Stack[*Scope]{}
+	state.interps = Stack[*Interp]{}
+}
+
+// showStack prints the top of the stack after its depth, bottom first.
+func (repl *Repl) showStack() {
+	values := repl.state.values.Items()
+	parts := []string{fmt.Sprintf("<%v>", len(values))}
+	if len(values) > maxStackShown {
+		parts = append(parts, "...")
+	}
+	for _, value := range values[max(0, len(values)-maxStackShown):] {
+		parts = append(parts, value.literal())
+	}
+	fmt.Println(strings.Join(parts, " "))
+}
+
+func (repl *Repl) help(string) (int, bool) {
+	usages := make([]string, len(repl.commands))
+	width := 0
+	for i, command := range repl.commands {
+		usages[i] = strings.TrimSpace(command.name + " " + command.args)
+		width = max(width, len(usages[i]))
+	}
+	for i, command := range repl.commands {
+		fmt.Printf("  %-*v  %v\n", width, usages[i], command.help)
+	}
+	return 0, false
+}
+
+func (repl *Repl) showAll(string) (int, bool) {
+	values := repl.state.values.Items()
+	if len(values) == 0 {
+		fmt.Println("the stack is empty")
+	}
+	for i, value := range values {
+		fmt.Printf("  %v: %v (%v)\n", i+1, value.literal(), value.kind)
+	}
+	return 0, false
+}
+
+func (repl *Repl) clear(string) (int, bool) {
+	before := slices.Clone(repl.state.values.Items())
+	repl.state.values = Stack[Value]{}
+	if repl.changed != nil {
+		repl.changed(before, true)
+	}
+	repl.show()
+	return 0, false
+}
+
+func (repl *Repl) load(filename string) (int, bool) {
+	if filename == "" {
+		fmt.Println("usage: .load <file>")
+		return 0, false
+	}
+	parseState, err := loadScript(filename, repl.state.options)
+	if err != nil {
+		printError(fmt.Errorf("failed to read file: %w", err), repl.state.options)
+		return 0, false
+	}
+	return repl.run(parseState)
+}
+
+func (repl *Repl) listWords(string) (int, bool) {
+	names := repl.state.words.names()
+	slices.Sort(names)
+	fmt.Println(strings.Join(names, " "))
+	return 0, false
+}
+
+func (repl *Repl) quit(string) (int, bool) {
+	return 0, true
+}
+
+// complete offers the REPL's commands at the start of a line, files after
+// `.load`, and defined words everywhere else.
+func (repl *Repl) complete(before, word string) []string {
+	if strings.TrimSpace(before) == "" {
+		candidates := repl.state.words.names()
+		for _, command := range repl.commands {
+			candidates = append(candidates, command.name)
+		}
+		return candidates
+	} else if strings.TrimSpace(before) == ".load" {
+		matches, _ := filepath.Glob(word + "*")
+		for i, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				matches[i] += string(filepath.Separator)
+			}
+		}
+		return matches
+	}
+	return repl.state.words.names()
+}
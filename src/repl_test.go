@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// newTestRepl starts a REPL reading input, with its history kept out of the
+// way.
+func newTestRepl(t *testing.T, input string) *Repl {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	words, err := loadStdLib(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repl := newRepl(words, Options{})
+	repl.editor.terminal = false
+	repl.editor.reader = bufio.NewReader(strings.NewReader(input))
+	return repl
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		source     string
+		incomplete bool
+	}{
+		{"1 2 +", false},
+		{": f", true},
+		{": f 1 {", true},
+		{"#( comment", true},
+		{`"""`, true},
+		{"<<END\nx", true},
+		{": f ( a --", true},
+		// errors more lines can't fix are reported straight away
+		{": foo { ;", false},
+		{"1 { ;", false},
+		{"}", false},
+		{`"open`, false},
+		{`: f "\q"`, false},
+		{"#( comment\n} ", true},
+	}
+	for _, test := range tests {
+		parseState := parseSource(test.source+"\n", 0)
+		if got := parseState.incomplete(); got != test.incomplete {
+			t.Errorf("%q incomplete: %v, want %v", test.source, got, test.incomplete)
+		}
+	}
+}
+
+func TestReadEntry(t *testing.T) {
+	repl := newTestRepl(t, ": f\n1 +\n;\n: foo { ;\n2 f\n\"\"\"\nx\n\"\"\" print\n")
+	want := []string{": f\n1 +\n;", ": foo { ;", "2 f", "\"\"\"\nx\n\"\"\" print"}
+	for _, entry := range want {
+		if got, err := repl.readEntry(); err != nil || got != entry {
+			t.Fatalf("read %q (%v), want %q", got, err, entry)
+		}
+	}
+	if got, err := repl.readEntry(); err == nil {
+		t.Errorf("read %q after the end of the input", got)
+	}
+}
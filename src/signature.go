@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StackType is what is known about a value on the stack, either from a
+// declared signature or from the checker.
+type StackType int
+
+const (
+	TypeAny StackType = iota
+	TypeNumber
+	TypeText
+)
+
+func (typ StackType) String() string {
+	switch typ {
+	case TypeAny:
+		return "any value"
+	case TypeNumber:
+		return "number"
+	case TypeText:
+		return "text"
+	}
+	return "unknown"
+}
+
+// suffix is the type annotation used when printing stack effects, matching
+// the letters used by builtins.tsv.
+func (typ StackType) suffix() string {
+	switch typ {
+	case TypeNumber:
+		return ":f"
+	case TypeText:
+		return ":s"
+	}
+	return ""
+}
+
+func (typ StackType) accepts(kind ValueKind) bool {
+	switch typ {
+	case TypeNumber:
+		return kind == ValueNumber
+	case TypeText:
+		return kind == ValueText
+	}
+	return true
+}
+
+func parseStackType(letter byte) (StackType, bool) {
+	switch letter {
+	case 'f', 'b':
+		return TypeNumber, true
+	case 's':
+		return TypeText, true
+	case 'v':
+		return TypeAny, true
+	}
+	return TypeAny, false
+}
+
+// parseStackTypes reads builtin metadata such as "2f" into a list of types.
+func parseStackTypes(spec string) []StackType {
+	typ := TypeAny
+	if len(spec) > 1 {
+		typ, _ = parseStackType(spec[1])
+	}
+	types := make([]StackType, int(spec[0]-'0'))
+	for i := range types {
+		types[i] = typ
+	}
+	return types
+}
+
+type Param struct {
+	name string
+	typ  StackType
+}
+
+// Signature is the stack effect declared for a definition, as in
+// `: area ( w:f h:f -- a:f ) * ;`, with values listed bottom to top.
+type Signature struct {
+	inputs  []Param
+	outputs []Param
+}
+
+func paramNames(params []Param) string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = param.name
+	}
+	return strings.Join(names, " ")
+}
+
+func (sig *Signature) String() string {
+	parts := []string{"("}
+	for _, param := range sig.inputs {
+		parts = append(parts, param.name+param.typ.suffix())
+	}
+	parts = append(parts, "--")
+	for _, param := range sig.outputs {
+		parts = append(parts, param.name+param.typ.suffix())
+	}
+	parts = append(parts, ")")
+	return strings.Join(parts, " ")
+}
+
+// effect converts the signature for the checker. Outputs named after an input
+// are taken to be that input passed through.
+func (sig *Signature) effect() *Effect {
+	effect := &Effect{}
+	for _, param := range sig.inputs {
+		effect.inputs = append(effect.inputs, param.typ)
+	}
+	for _, param := range sig.outputs {
+		out := EffectOut{param.typ, -1}
+		for i, input := range sig.inputs {
+			if input.name == param.name {
+				out.from = i
+			}
+		}
+		effect.outputs = append(effect.outputs, out)
+	}
+	return effect
+}
+
+// parseSignature reads the text of a stack-effect comment. Comments without
+// a `--` aren't signatures, and return nil.
+func parseSignature(text string) (*Signature, error) {
+	fields := strings.Fields(text)
+	split := -1
+	for i, field := range fields {
+		if field != "--" {
+			continue
+		} else if split >= 0 {
+			return nil, fmt.Errorf("stack effect has more than one `--`")
+		}
+		split = i
+	}
+	if split < 0 {
+		return nil, nil
+	}
+	sig := &Signature{}
+	for i, field := range fields {
+		if i == split {
+			continue
+		}
+		param := Param{name: field}
+		if name, letter, ok := strings.Cut(field, ":"); ok {
+			typ, known := TypeAny, false
+			if len(letter) == 1 {
+				typ, known = parseStackType(letter[0])
+			}
+			if name == "" || !known {
+				return nil, fmt.Errorf("malformed stack effect slot `%v`, expected a name followed by `:f`, `:b`, `:s` or `:v`", field)
+			}
+			param = Param{name, typ}
+		}
+		if i < split {
+			sig.inputs = append(sig.inputs, param)
+		} else {
+			sig.outputs = append(sig.outputs, param)
+		}
+	}
+	return sig, nil
+}
@@ -18,6 +18,11 @@ func (s *Stack[T]) Pop() (T, bool) {
 	return last, true
 }
 
+// Drop removes the top count items, which must be there.
+func (s *Stack[T]) Drop(count int) {
+	s.items = s.items[:len(s.items)-count]
+}
+
 func (s *Stack[T]) Peek() (T, bool) {
 	if len(s.items) == 0 {
 		var zero T
@@ -26,6 +31,11 @@ func (s *Stack[T]) Peek() (T, bool) {
 	return s.items[len(s.items)-1], true
 }
 
+// Items returns the items from the bottom of the stack to the top.
+func (s *Stack[T]) Items() []T {
+	return s.items
+}
+
 func (s *Stack[T]) Len() int {
 	return len(s.items)
 }
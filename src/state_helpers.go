@@ -1,138 +1,219 @@
 package main
 
+import "fmt"
+
 // Organization:
 // pop/push
 // value/string/float/bool
 // 1/2/3
 
-func (state *EvalState) pop1v() (a Value, ok bool) {
-	a, ok = state.values.Pop()
+// underflowError is returned by the pop helpers when there aren't enough
+// values on the stack. call adds the name of the word that failed.
+type underflowError struct {
+	needs int
+	found int
+}
+
+func (err *underflowError) Error() string {
+	return fmt.Sprintf("stack underflow: needs %v, found %v", plural(err.needs, "value"), err.found)
+}
+
+// typeError is returned by the pop helpers when a value is the wrong kind.
+type typeError struct {
+	expected ValueKind
+	got      ValueKind
+}
+
+func (err *typeError) Error() string {
+	return fmt.Sprintf("type error: expected %v, got %v", err.expected, err.got)
+}
+
+func (state *EvalState) need(count int) error {
+	if state.values.Len() < count {
+		return &underflowError{count, state.values.Len()}
+	}
+	return nil
+}
+
+// checkKinds returns a type error for the first value that isn't of kind.
+func checkKinds(kind ValueKind, values ...Value) error {
+	for _, value := range values {
+		if value.kind != kind {
+			return &typeError{kind, value.kind}
+		}
+	}
+	return nil
+}
+
+// The pop helpers check every value they need before popping any of them, so
+// a builtin that fails leaves the stack as it found it. top and topKind
+// return the values to be popped, which are only valid until the stack next
+// changes.
+
+func (state *EvalState) top(count int) ([]Value, error) {
+	if err := state.need(count); err != nil {
+		return nil, err
+	}
+	items := state.values.Items()
+	return items[len(items)-count:], nil
+}
+
+func (state *EvalState) topKind(count int, kind ValueKind) ([]Value, error) {
+	values, err := state.top(count)
+	if err == nil {
+		err = checkKinds(kind, values...)
+	}
+	return values, err
+}
+
+func (state *EvalState) pop1v() (a Value, err error) {
+	values, err := state.top(1)
+	if err == nil {
+		a = values[0]
+		state.values.Drop(1)
+	}
 	return
 }
 
-func (state *EvalState) pop2v() (a, b Value, ok bool) {
-	b, bk := state.values.Pop()
-	a, ak := state.values.Pop()
-	ok = ak && bk
+func (state *EvalState) pop2v() (a, b Value, err error) {
+	values, err := state.top(2)
+	if err == nil {
+		a, b = values[0], values[1]
+		state.values.Drop(2)
+	}
 	return
 }
 
-func (state *EvalState) pop3v() (a, b, c Value, ok bool) {
-	c, ck := state.values.Pop()
-	b, bk := state.values.Pop()
-	a, ak := state.values.Pop()
-	ok = ak && bk && ck
+func (state *EvalState) pop3v() (a, b, c Value, err error) {
+	values, err := state.top(3)
+	if err == nil {
+		a, b, c = values[0], values[1], values[2]
+		state.values.Drop(3)
+	}
+	return
+}
+
+func (state *EvalState) pop1s() (a string, err error) {
+	values, err := state.topKind(1, ValueText)
+	if err == nil {
+		a = values[0].text
+		state.values.Drop(1)
+	}
 	return
 }
 
-func (state *EvalState) pop1s() (a string, ok bool) {
-	av, ok := state.pop1v()
-	ok = ok && (av.kind == ValueText)
-	if ok {
-		a = av.text
+func (state *EvalState) pop2s() (a, b string, err error) {
+	values, err := state.topKind(2, ValueText)
+	if err == nil {
+		a, b = values[0].text, values[1].text
+		state.values.Drop(2)
 	}
 	return
 }
 
-func (state *EvalState) pop2s() (a, b string, ok bool) {
-	av, bv, ok := state.pop2v()
-	ok = ok && av.kind == ValueText && bv.kind == ValueText
-	if ok {
-		a, b = av.text, bv.text
+func (state *EvalState) pop3s() (a, b, c string, err error) {
+	values, err := state.topKind(3, ValueText)
+	if err == nil {
+		a, b, c = values[0].text, values[1].text, values[2].text
+		state.values.Drop(3)
 	}
 	return
 }
 
-func (state *EvalState) pop3s() (a, b, c string, ok bool) {
-	av, bv, cv, ok := state.pop3v()
-	ok = ok && av.kind == ValueText && bv.kind == ValueText && cv.kind == ValueText
-	if ok {
-		a, b, c = av.text, bv.text, cv.text
+func (state *EvalState) pop1f() (a float64, err error) {
+	values, err := state.topKind(1, ValueNumber)
+	if err == nil {
+		a = values[0].number
+		state.values.Drop(1)
 	}
 	return
 }
 
-func (state *EvalState) pop1f() (a float64, ok bool) {
-	av, ok := state.pop1v()
-	ok = ok && (av.kind == ValueNumber)
-	if ok {
-		a = av.number
+func (state *EvalState) pop2f() (a, b float64, err error) {
+	values, err := state.topKind(2, ValueNumber)
+	if err == nil {
+		a, b = values[0].number, values[1].number
+		state.values.Drop(2)
 	}
 	return
 }
 
-func (state *EvalState) pop2f() (a, b float64, ok bool) {
-	av, bv, ok := state.pop2v()
-	ok = ok && av.kind == ValueNumber && bv.kind == ValueNumber
-	if ok {
-		a, b = av.number, bv.number
+func (state *EvalState) pop3f() (a, b, c float64, err error) {
+	values, err := state.topKind(3, ValueNumber)
+	if err == nil {
+		a, b, c = values[0].number, values[1].number, values[2].number
+		state.values.Drop(3)
 	}
 	return
 }
 
-func (state *EvalState) pop3f() (a, b, c float64, ok bool) {
-	av, bv, cv, ok := state.pop3v()
-	ok = ok && av.kind == ValueNumber && bv.kind == ValueNumber && cv.kind == ValueNumber
-	if ok {
-		a, b, c = av.number, bv.number, cv.number
+func (state *EvalState) pop1b() (a bool, err error) {
+	values, err := state.topKind(1, ValueNumber)
+	if err == nil {
+		a = floatToBool(values[0].number)
+		state.values.Drop(1)
 	}
 	return
 }
 
-func (state *EvalState) pop1b() (a bool, ok bool) {
-	af, ok := state.pop1f()
-	if ok {
-		a = floatToBool(af)
+func (state *EvalState) pop2b() (a, b bool, err error) {
+	values, err := state.topKind(2, ValueNumber)
+	if err == nil {
+		a, b = floatToBool(values[0].number), floatToBool(values[1].number)
+		state.values.Drop(2)
 	}
 	return
 }
 
-func (state *EvalState) pop2b() (a, b, ok bool) {
-	af, bf, ok := state.pop2f()
-	if ok {
-		a, b = floatToBool(af), floatToBool(bf)
+func (state *EvalState) pop3b() (a, b, c bool, err error) {
+	values, err := state.topKind(3, ValueNumber)
+	if err == nil {
+		a, b, c = floatToBool(values[0].number), floatToBool(values[1].number), floatToBool(values[2].number)
+		state.values.Drop(3)
 	}
 	return
 }
 
-func (state *EvalState) pop3b() (a, b, c, ok bool) {
-	af, bf, cf, ok := state.pop3f()
-	if ok {
-		a, b, c = floatToBool(af), floatToBool(bf), floatToBool(cf)
+// peek1s is pop1s without the pop, for builtins that can still fail after
+// their input has been checked.
+func (state *EvalState) peek1s() (a string, err error) {
+	values, err := state.topKind(1, ValueText)
+	if err == nil {
+		a = values[0].text
 	}
 	return
 }
 
-func (state *EvalState) push1v(a Value) bool {
+func (state *EvalState) push1v(a Value) error {
 	state.values.Push(a)
-	return true
+	return nil
 }
 
-func (state *EvalState) push2v(a, b Value) bool {
+func (state *EvalState) push2v(a, b Value) error {
 	state.values.Push(a)
 	state.values.Push(b)
-	return true
+	return nil
 }
 
-func (state *EvalState) push3v(a, b, c Value) bool {
+func (state *EvalState) push3v(a, b, c Value) error {
 	state.values.Push(a)
 	state.values.Push(b)
 	state.values.Push(c)
-	return true
+	return nil
 }
 
-func (state *EvalState) push1s(a string) bool {
+func (state *EvalState) push1s(a string) error {
 	return state.push1v(Value{kind: ValueText, text: a})
 }
 
-func (state *EvalState) push2s(a, b string) bool {
+func (state *EvalState) push2s(a, b string) error {
 	return state.push2v(
 		Value{kind: ValueText, text: a},
 		Value{kind: ValueText, text: b},
 	)
 }
 
-func (state *EvalState) push3s(a, b, c string) bool {
+func (state *EvalState) push3s(a, b, c string) error {
 	return state.push3v(
 		Value{kind: ValueText, text: a},
 		Value{kind: ValueText, text: b},
@@ -140,18 +221,18 @@ func (state *EvalState) push3s(a, b, c string) bool {
 	)
 }
 
-func (state *EvalState) push1f(a float64) bool {
+func (state *EvalState) push1f(a float64) error {
 	return state.push1v(Value{kind: ValueNumber, number: a})
 }
 
-func (state *EvalState) push2f(a, b float64) bool {
+func (state *EvalState) push2f(a, b float64) error {
 	return state.push2v(
 		Value{kind: ValueNumber, number: a},
 		Value{kind: ValueNumber, number: b},
 	)
 }
 
-func (state *EvalState) push3f(a, b, c float64) bool {
+func (state *EvalState) push3f(a, b, c float64) error {
 	return state.push3v(
 		Value{kind: ValueNumber, number: a},
 		Value{kind: ValueNumber, number: b},
@@ -159,14 +240,14 @@ func (state *EvalState) push3f(a, b, c float64) bool {
 	)
 }
 
-func (state *EvalState) push1b(a bool) bool {
+func (state *EvalState) push1b(a bool) error {
 	return state.push1f(boolToFloat(a))
 }
 
-func (state *EvalState) push2b(a, b bool) bool {
+func (state *EvalState) push2b(a, b bool) error {
 	return state.push2f(boolToFloat(a), boolToFloat(b))
 }
 
-func (state *EvalState) push3b(a, b, c bool) bool {
+func (state *EvalState) push3b(a, b, c bool) error {
 	return state.push3f(boolToFloat(a), boolToFloat(b), boolToFloat(c))
 }
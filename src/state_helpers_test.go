@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runState runs source with the standard library loaded, returning the state
+// it finished in.
+func runState(t *testing.T, source string, options Options) *EvalState {
+	t.Helper()
+	words, err := loadStdLib(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseState := parse(lex("test.w", strings.NewReader(source), 0))
+	if parseState.err != nil {
+		t.Fatal(parseState.err)
+	}
+	var state *EvalState
+	captureStdout(t, func() {
+		evalState := eval(parseState, words, options)
+		state = &evalState
+	})
+	return state
+}
+
+// TestFailedCallKeepsStack checks that a word failing part way through its
+// inputs leaves the stack exactly as it found it.
+func TestFailedCallKeepsStack(t *testing.T) {
+	tests := []struct {
+		setup string // leaves the stack the failing word is called on
+		word  string
+		code  ErrorCode
+	}{
+		{`1 "x"`, "+", CodeTypeMismatch},
+		{`"x" 1`, "+", CodeTypeMismatch},
+		{`7 1 +`, "+", CodeUnderflow},
+		{`2`, "/", CodeUnderflow},
+		{``, "drop", CodeUnderflow},
+		{`1 2`, "rot", CodeUnderflow},
+		{`"a" 1`, "strconcat", CodeTypeMismatch},
+		{`5 "b" "a" strconcat`, "strconcat", CodeTypeMismatch},
+		{`0.5`, "exit", CodeBuiltinFailed},
+		{`"/no/such/file"`, "loadfile", CodeBuiltinFailed},
+		{`"/no/such/file"`, "runfile", CodeBuiltinFailed},
+		{`"nothing"`, "forget", CodeUndefined},
+		{`"dup"`, "forget", CodeForget},
+		{`1 "1 +" runstring "x"`, "+", CodeTypeMismatch},
+		{`: f ( a:f -- ) drop ; "x"`, "f", CodeTypeMismatch},
+	}
+	for _, engine := range engines {
+		for _, test := range tests {
+			before := runState(t, test.setup, Options{engine: engine})
+			if before.err != nil {
+				t.Fatalf("%q failed: %v", test.setup, before.err)
+			}
+			after := runState(t, test.setup+" "+test.word, Options{engine: engine})
+			if code := errorCode(after.err); code != test.code {
+				t.Errorf("%v: %q %q failed with %q (%v), want %q", engine, test.setup, test.word, code, after.err, test.code)
+			}
+			if got, want := after.values.Items(), before.values.Items(); !slices.Equal(got, want) {
+				t.Errorf("%v: %q %q left %v, want %v", engine, test.setup, test.word, got, want)
+			}
+		}
+	}
+}
+
+// TestBuiltinErrors checks the messages builtins fail with, which name the
+// word and say what was wrong.
+func TestBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{`1 +`, "stack underflow: `+` needs 2 values, found 1"},
+		{`drop`, "stack underflow: `drop` needs 1 value, found 0"},
+		{`5 strlen`, "type error: `strlen` expected text, got number"},
+		{`"a" 1 strconcat`, "type error: `strconcat` expected text, got number"},
+		{`0.5 exit`, "`exit`: exit status should be a whole number from 0 to 255, got 0.5"},
+		{`"/no/such/file" loadfile`, "`loadfile`: failed to read file: open /no/such/file: no such file or directory"},
+	}
+	for _, engine := range engines {
+		for _, test := range tests {
+			state := runState(t, test.source, Options{engine: engine})
+			diag, _, ok := asDiagnostic(state.err)
+			if !ok {
+				t.Errorf("%v: %q failed with %v, want a diagnostic", engine, test.source, state.err)
+				continue
+			}
+			if diag.message != test.message {
+				t.Errorf("%v: %q failed with %q, want %q", engine, test.source, diag.message, test.message)
+			}
+		}
+	}
+}
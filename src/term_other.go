@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// rawMode isn't supported here, so lines are read as the terminal gives them,
+// without editing keys, recalling history or completion.
+func rawMode(fd int) (restore func(), err error) {
+	return nil, errors.New("raw mode isn't supported on this platform")
+}
@@ -0,0 +1,84 @@
+package main
+
+import "fmt"
+
+// Engine picks how scripts are run: compiled to bytecode for the VM, or by
+// walking the token tree directly.
+type Engine int
+
+const (
+	EngineVM Engine = iota
+	EngineTree
+)
+
+func (engine Engine) String() string {
+	switch engine {
+	case EngineVM:
+		return "vm"
+	case EngineTree:
+		return "tree"
+	}
+	return "unknown"
+}
+
+func parseEngine(text string) (Engine, error) {
+	for _, engine := range []Engine{EngineVM, EngineTree} {
+		if engine.String() == text {
+			return engine, nil
+		}
+	}
+	return EngineVM, fmt.Errorf("unknown engine `%v`", text)
+}
+
+// run executes compiled code until every scope has finished or there's an
+// error. It mirrors step, sharing its helpers.
+func (state *EvalState) run() {
+	for state.err == nil {
+		scope, ok := state.scopes.Peek()
+		if !ok {
+			return
+		}
+		instrs := scope.code.instrs
+		if scope.index >= len(instrs) {
+			state.popScope()
+			continue
+		}
+		instr := &instrs[scope.index]
+		switch instr.op {
+		case OpPush:
+			state.values.Push(instr.value)
+		case OpCall:
+			if !state.call(instr.token.value.text, state.words.words[instr.arg]) {
+				return
+			}
+		case OpDefine:
+			if !state.define(instr.token.value.text, Word{token: instr.token}) {
+				return
+			}
+		case OpLoop:
+			run, ok := state.loopCondition()
+			if !ok {
+				return
+			} else if !run {
+				scope.index = instr.arg
+				continue
+			}
+		case OpJump:
+			scope.index = instr.arg
+			continue
+		case OpInterpBegin:
+			if !state.beginInterp(instr.arg) {
+				return
+			}
+		case OpInterpAppend:
+			if !state.appendWord(instr.token.value.text) {
+				return
+			}
+		case OpInterpHole:
+			state.appendHole(instr.arg)
+		case OpInterpEnd:
+			state.endInterp()
+		}
+		scope.index++
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// engineModes are the ways a script can be run, which should all agree.
+var engineModes = []struct {
+	name     string
+	engine   Engine
+	optimize bool
+}{
+	{"vm", EngineVM, false},
+	{"tree", EngineTree, false},
+	{"vm -O", EngineVM, true},
+	{"tree -O", EngineTree, true},
+}
+
+// TestEnginesAgree runs each script every way it can be run, checking they all
+// print what they should and fail the way they should.
+func TestEnginesAgree(t *testing.T) {
+	type engineTest struct {
+		source string
+		output string
+		fails  string // the error's code, or its message if it has none
+	}
+	tests := map[string]engineTest{
+		"arithmetic": {`2 3 + 4 * println 7 2 mod println 1 0 / println`, "20\n1\n+Inf\n", ""},
+		"strings":    {`"a" "b" strconcat println 1 2 f"{} and {}" println`, "ab\n1 and 2\n", ""},
+		"loop":       {`0 5 dup { dup rot + swap -- dup } drop println`, "15\n", ""},
+		"nested":     {`3 dup { 2 dup { "." print -- dup } drop "\n" print -- dup } drop`, "..\n..\n..\n", ""},
+		"recursion":  {`: fact dup 1 > { dup 1 - fact * 0 } ; 10 fact println`, "3.6288e+06\n", ""},
+		"mutual":     {`3 ping : ping dup { "ping " print dup -- pong 0 } drop ; : pong dup { "pong " print dup -- ping 0 } drop ;`, "ping pong ping ", ""},
+		"hoisting":   {`4 sq println : sq dup * ;`, "16\n", ""},
+		"redefine":   {`: two 2 ; two println : two 3 ; two println`, "2\n3\n", ""},
+		"interp":     {`: five 5 ; 1 f"{five} {dup}" println`, "5 1\n", ""},
+		"runstring":  {`": six 6 ;" runstring six println`, "6\n", ""},
+		"marker":     {`: tmp 0 ; "scratch" marker : tmp 1 ; tmp println scratch tmp println`, "1\n0\n", ""},
+		"underflow":  {`"before" println 1 +`, "before\n", string(CodeUnderflow)},
+		"type":       {`: f "x" + ; 1 f`, "", string(CodeTypeMismatch)},
+		"signature":  {`: f ( a:f -- b:f ) drop "x" ; 1 f`, "", string(CodeSignature)},
+		"undefined":  {`"a" println typo`, "", string(CodeUndefined)},
+		"exit":       {`"bye" println 3 exit "unreachable" println`, "bye\n", "exit status 3"},
+	}
+	if !testing.Short() {
+		outputs := map[string]string{"collatz.w": "2.864311e+06\n", "fib.w": "75025\n", "loop.w": "5.000005e+11\n"}
+		for name, output := range outputs {
+			source, err := os.ReadFile(filepath.Join("../bench", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests[name] = engineTest{string(source), output, ""}
+		}
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var firstErr error
+			for i, mode := range engineModes {
+				output, err := runOptimized(t, test.source, Options{engine: mode.engine}, mode.optimize)
+				if output != test.output {
+					t.Errorf("%v printed %q, want %q", mode.name, output, test.output)
+				}
+				if fails := failure(err); fails != test.fails {
+					t.Errorf("%v failed with %q (%v), want %q", mode.name, fails, err, test.fails)
+				} else if i == 0 {
+					firstErr = err
+				} else if err != nil && err.Error() != firstErr.Error() {
+					t.Errorf("%v failed with %q, but %v failed with %q", mode.name, err, engineModes[0].name, firstErr)
+				}
+			}
+		})
+	}
+}
+
+// failure is how err is told apart in tests: its code, or its message if it
+// has none.
+func failure(err error) string {
+	if err == nil {
+		return ""
+	} else if code := errorCode(err); code != "" {
+		return string(code)
+	}
+	return err.Error()
+}
+
+// TestCompiledCodeIsPerDictionary runs one parsed tree against two
+// dictionaries that number their slots differently.
+func TestCompiledCodeIsPerDictionary(t *testing.T) {
+	parseState := parseSource(`: A "A" print ; : B "B" print ; A B`, 0)
+	for _, order := range [][]string{{"A", "B"}, {"B", "A"}, {"A", "B"}} {
+		words, err := loadStdLib(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range order {
+			words.slot(name)
+		}
+		var state EvalState
+		output := captureStdout(t, func() {
+			state = eval(parseState, words, Options{engine: EngineVM})
+		})
+		if state.err != nil || output != "AB" {
+			t.Errorf("with slots in the order %v, printed %q and failed with %v, want \"AB\"", order, output, state.err)
+		}
+	}
+}